@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	metadataSource = flag.String("metadata-source", "",
+		"Fill in tags MPD doesn't keep from another library, currently only beets")
+	beetsLibrary = flag.String("beets-library", "",
+		"The beets library database, defaults to ~/.config/beets/library.db")
+)
+
+// Separators that can't turn up in paths or tags, for reading sqlite3 output
+const (
+	beetsFieldSep = "\x1f"
+	beetsRowSep   = "\x1e"
+)
+
+func validateMetadataSource() error {
+	switch *metadataSource {
+	case "", "beets":
+		return nil
+	}
+	return fmt.Errorf("Unknown -metadata-source '%s', expected beets", *metadataSource)
+}
+
+func beetsLibraryPath() (string, error) {
+	if *beetsLibrary != "" {
+		return *beetsLibrary, nil
+	}
+	base := os.Getenv("XDG_CONFIG_HOME")
+	if base == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		base = filepath.Join(home, ".config")
+	}
+	return filepath.Join(base, "beets", "library.db"), nil
+}
+
+// Adds the tags beets knows about to tracks, matching them by path. Beets keeps
+// absolute paths, so this needs music_directory to line them up with MPD's.
+// Nothing here is fatal, tracks just go without the extra tags.
+func addBeetsMetadata(tracks []*Track) {
+	if musicDir == "" {
+		info("No music_directory in the MPD config, not reading beets metadata")
+		return
+	}
+	library, err := beetsLibraryPath()
+	if err == nil {
+		_, err = os.Stat(library)
+	}
+	if err != nil {
+		info("Not reading beets metadata: %v", err)
+		return
+	}
+
+	// The library is only ever opened read-only, beets may be using it
+	cmd := exec.Command("sqlite3", "-readonly", "-batch",
+		"-separator", beetsFieldSep, "-newline", beetsRowSep, library,
+		"SELECT CAST(path AS TEXT), original_year, acoustid_id FROM items")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		info("Not reading beets metadata: %v %s", err, strings.TrimSpace(stderr.String()))
+		return
+	}
+
+	byPath := make(map[string]*Track, len(tracks))
+	for _, t := range tracks {
+		byPath[t.Path] = t
+	}
+
+	prefix := filepath.Clean(musicDir) + string(filepath.Separator)
+	matched := 0
+	scan := bufio.NewScanner(bytes.NewReader(out))
+	scan.Buffer(nil, 1024*1024)
+	scan.Split(splitOn(beetsRowSep))
+	for scan.Scan() {
+		cols := strings.Split(scan.Text(), beetsFieldSep)
+		if len(cols) != 3 || !strings.HasPrefix(cols[0], prefix) {
+			continue
+		}
+		t := byPath[strings.TrimPrefix(cols[0], prefix)]
+		if t == nil {
+			continue
+		}
+		// Beets stores 0 for an unknown year
+		if cols[1] != "0" {
+			t.OriginalYear = cols[1]
+		}
+		t.AcoustID = cols[2]
+		matched++
+	}
+	debug("Matched %d tracks in the beets library", matched)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+var browse = flag.Bool("browse", false,
+	"Pick artists first, then tracks from them. Esc in the track list goes back to the artists")
+
+func artistKey(t *Track) string {
+	if t.AlbumArtist != "" {
+		return t.AlbumArtist
+	}
+	return t.Artist
+}
+
+const unknownArtist = "[Unknown Artist]"
+
+func splitLines(output []byte) []string {
+	return strings.Split(strings.TrimSuffix(string(output), "\n"), "\n")
+}
+
+// Picks artists and then tracks by them. Every pass either returns or starts
+// with the artist picker, and aborting that exits, so there's always a way out.
+func browseSongs(tracks []*Track) []string {
+	byArtist := map[string][]*Track{}
+	for _, t := range tracks {
+		key := artistKey(t)
+		if key == "" {
+			key = unknownArtist
+		}
+		byArtist[key] = append(byArtist[key], t)
+	}
+	artists := make([]string, 0, len(byArtist))
+	for a := range byArtist {
+		artists = append(artists, a)
+	}
+	sort.Strings(artists)
+
+	query := ""
+	for {
+		// The query comes back first so it can be restored when going back
+		out := splitLines(runFzf(
+			[]string{"-m", "--print-query", "--prompt=Artist> ", "--query=" + query},
+			func(w io.Writer) {
+				for _, a := range artists {
+					fmt.Fprintln(w, a)
+				}
+			}))
+		query = out[0]
+		if len(out) < 2 {
+			return nil
+		}
+
+		selected := []*Track{}
+		for _, a := range out[1:] {
+			selected = append(selected, byArtist[a]...)
+		}
+
+		args := append(trackFzfArgs(), "--expect=esc")
+		if *showPreview {
+			// Indexed by position, so it has to be written for each pass's tracks
+			args = append(args, previewArgs(selected)...)
+		}
+		// The key that closed fzf comes first, empty for enter
+		out = splitLines(runFzf(args, func(w io.Writer) {
+			writeLines(w, selected)
+		}))
+		if out[0] == "esc" {
+			continue
+		}
+		return parseFzfOutput([]byte(strings.Join(out[1:], "\n")))
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/gob"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Bump whenever parsing changes so old caches are ignored
+const cacheVersion = 11
+
+type trackCache struct {
+	Version int
+	DbFile  string
+	Options string
+	ModTime time.Time
+	Size    int64
+	Tracks  []*Track
+}
+
+// The flags that change how the database is read, so a cache written with
+// different ones isn't used
+func parseOptions() string {
+	return fmt.Sprintf("nul=%t gzip=%t no-gzip=%t", *nulRecords, *forceGzip, *noGzip)
+}
+
+// Returns "" if there's no usable cache directory, in which case the cache
+// is skipped.
+func cacheDir() string {
+	dir := *cacheDirFlag
+	if dir == "" {
+		base := os.Getenv("XDG_CACHE_HOME")
+		if base == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return ""
+			}
+			base = filepath.Join(home, ".cache")
+		}
+		dir = filepath.Join(base, "mpd-fzf")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		debug("Not using the cache: %v", err)
+		return ""
+	}
+	return dir
+}
+
+func loadCache(path, dbFile string, st os.FileInfo) []*Track {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var c trackCache
+	if err = gob.NewDecoder(f).Decode(&c); err != nil {
+		debug("Ignoring unreadable cache '%s': %v", path, err)
+		return nil
+	}
+	if c.Version != cacheVersion || c.DbFile != dbFile || c.Options != parseOptions() ||
+		!c.ModTime.Equal(st.ModTime()) || c.Size != st.Size() {
+		return nil
+	}
+	return c.Tracks
+}
+
+func saveCache(path, dbFile string, st os.FileInfo, tracks []*Track) {
+	// Write to a temporary file so concurrent runs never see a partial cache
+	f, err := ioutil.TempFile(filepath.Dir(path), "tracks-*.tmp")
+	if err != nil {
+		debug("Not writing the cache: %v", err)
+		return
+	}
+	defer os.Remove(f.Name())
+
+	err = gob.NewEncoder(f).Encode(trackCache{
+		Version: cacheVersion,
+		DbFile:  dbFile,
+		Options: parseOptions(),
+		ModTime: st.ModTime(),
+		Size:    st.Size(),
+		Tracks:  tracks,
+	})
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		debug("Not writing the cache: %v", err)
+	}
+}
+
+func readDbCached(dbFile string) ([]*Track, error) {
+	dir := ""
+	// A limited parse isn't worth caching, and anomalies are only found by parsing
+	if *useCache && *parseLimit == 0 && !*strict && !*validateDb {
+		dir = cacheDir()
+	}
+	if dir == "" {
+		return readDb(dbFile)
+	}
+
+	st, err := os.Stat(dbFile)
+	if err != nil {
+		return nil, err
+	}
+	// One cache per database so several -db-file sources don't evict each other
+	h := fnv.New64a()
+	h.Write([]byte(dbFile))
+	path := filepath.Join(dir, fmt.Sprintf("tracks-%x.gob", h.Sum64()))
+	if tracks := loadCache(path, dbFile, st); tracks != nil {
+		return tracks, nil
+	}
+
+	tracks, err := readDb(dbFile)
+	if err == nil {
+		saveCache(path, dbFile, st, tracks)
+	}
+	return tracks, err
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+var dedupe = flag.String("dedupe", "",
+	"Collapse duplicate tracks: 'path' for identical paths, 'fuzzy' for the same artist, title, "+
+		"and album ignoring case and accents")
+
+var preferExt = flag.String("prefer-ext", "flac,opus,ogg,m4a,mp3",
+	"Formats to keep when -dedupe=fuzzy finds copies, best first. Unlisted formats are kept last")
+
+// Parsed from -prefer-ext, lower is better
+var extPriority map[string]int
+
+var diacritics = map[rune]rune{}
+
+func init() {
+	for base, accented := range map[rune]string{
+		'a': "àáâãäåāăą",
+		'c': "çćĉċč",
+		'd': "ďđ",
+		'e': "èéêëēĕėęě",
+		'g': "ĝğġģ",
+		'h': "ĥħ",
+		'i': "ìíîïĩīĭįı",
+		'j': "ĵ",
+		'k': "ķ",
+		'l': "ĺļľŀł",
+		'n': "ñńņňŉ",
+		'o': "òóôõöøōŏő",
+		'r': "ŕŗř",
+		's': "śŝşšș",
+		't': "ţťŧț",
+		'u': "ùúûüũūŭůűų",
+		'w': "ŵ",
+		'y': "ýÿŷ",
+		'z': "źżž",
+	} {
+		for _, r := range accented {
+			diacritics[r] = base
+		}
+	}
+}
+
+// Lowercases, strips common Latin diacritics, and collapses whitespace
+func normalize(s string) string {
+	var b strings.Builder
+	space := false
+	for _, r := range strings.ToLower(s) {
+		if unicode.IsSpace(r) {
+			space = b.Len() > 0
+			continue
+		}
+		if base, ok := diacritics[r]; ok {
+			r = base
+		}
+		if space {
+			b.WriteByte(' ')
+			space = false
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func parseExtPriority(list string) map[string]int {
+	priority := map[string]int{}
+	for _, ext := range strings.Split(list, ",") {
+		ext = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), "."))
+		if _, ok := priority[ext]; !ok && ext != "" {
+			priority[ext] = len(priority)
+		}
+	}
+	return priority
+}
+
+func extRank(t *Track) int {
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(t.Filename), "."))
+	if rank, ok := extPriority[ext]; ok {
+		return rank
+	}
+	return len(extPriority)
+}
+
+func dedupeKey(t *Track, mode string) string {
+	// Untitled tracks can't be identified
+	if mode == "path" || t.Title == "" {
+		return canonicalPath(t.Path)
+	}
+	return normalize(t.Artist) + delimiter + normalize(t.Title) + delimiter + normalize(t.Album)
+}
+
+// Keeps one track per key in the position of its first copy, preferring
+// formats earlier in -prefer-ext
+func dedupeTracks(tracks []*Track, mode string) []*Track {
+	if extPriority == nil {
+		extPriority = parseExtPriority(*preferExt)
+	}
+	kept := []*Track{}
+	index := map[string]int{}
+	for _, t := range tracks {
+		key := dedupeKey(t, mode)
+		i, ok := index[key]
+		if !ok {
+			index[key] = len(kept)
+			kept = append(kept, t)
+			continue
+		}
+		if extRank(t) < extRank(kept[i]) {
+			debug("Preferring %s over %s", t.Path, kept[i].Path)
+			kept[i] = t
+		} else {
+			debug("Preferring %s over %s", kept[i].Path, t.Path)
+		}
+	}
+	return kept
+}
+
+func validateDedupe() error {
+	switch *dedupe {
+	case "", "path", "fuzzy":
+		return nil
+	}
+	return fmt.Errorf("Unknown -dedupe mode '%s', expected 'path' or 'fuzzy'", *dedupe)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"Sigur Rós", "sigur ros"},
+		{"  Björk   Guðmundsdóttir ", "bjork guðmundsdottir"},
+		{"MOTÖRHEAD", "motorhead"},
+	}
+	for _, tt := range tests {
+		if got := normalize(tt.in); got != tt.want {
+			t.Errorf("normalize(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestFuzzyDedupe(t *testing.T) {
+	tracks := []*Track{
+		{Path: "mp3/Sigur Ros/Hoppipolla.mp3", Filename: "Hoppipolla.mp3",
+			Artist: "Sigur Ros", Title: "Hoppipolla", Album: "Takk..."},
+		{Path: "flac/Sigur Rós/Hoppípolla.flac", Filename: "Hoppípolla.flac",
+			Artist: "Sigur Rós", Title: "Hoppípolla", Album: "Takk..."},
+		{Path: "mp3/Sigur Ros/Glosoli.mp3", Filename: "Glosoli.mp3",
+			Artist: "Sigur Ros", Title: "Glósóli", Album: "Takk..."},
+		// A different album is a different recording
+		{Path: "flac/Sigur Rós/live/Hoppípolla.flac", Filename: "Hoppípolla.flac",
+			Artist: "Sigur Rós", Title: "Hoppípolla", Album: "Heima"},
+		// Nothing to match untitled tracks on but their paths
+		{Path: "a.mp3", Filename: "a.mp3"},
+		{Path: "b.flac", Filename: "b.flac"},
+	}
+	old := extPriority
+	extPriority = parseExtPriority("flac,mp3")
+	defer func() { extPriority = old }()
+
+	want := []string{
+		"flac/Sigur Rós/Hoppípolla.flac",
+		"mp3/Sigur Ros/Glosoli.mp3",
+		"flac/Sigur Rós/live/Hoppípolla.flac",
+		"a.mp3",
+		"b.flac",
+	}
+	if got := paths(dedupeTracks(tracks, "fuzzy")); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestPreferExt(t *testing.T) {
+	copies := func() []*Track {
+		return []*Track{
+			{Path: "mp3/song.mp3", Filename: "song.mp3", Artist: "A", Title: "Song"},
+			{Path: "opus/song.opus", Filename: "song.opus", Artist: "A", Title: "Song"},
+			{Path: "flac/song.FLAC", Filename: "song.FLAC", Artist: "A", Title: "Song"},
+		}
+	}
+	tests := []struct{ prefer, want string }{
+		{"flac,opus,mp3", "flac/song.FLAC"},
+		{"opus,flac,mp3", "opus/song.opus"},
+		{".mp3, .opus", "mp3/song.mp3"},
+		// Unlisted formats tie, so the first copy stays
+		{"ogg", "mp3/song.mp3"},
+		{"ogg,opus", "opus/song.opus"},
+	}
+	old := extPriority
+	defer func() { extPriority = old }()
+	for _, tt := range tests {
+		extPriority = parseExtPriority(tt.prefer)
+		kept := dedupeTracks(copies(), "fuzzy")
+		if len(kept) != 1 || kept[0].Path != tt.want {
+			t.Errorf("-prefer-ext %s: kept %q, want %s", tt.prefer, paths(kept), tt.want)
+		}
+	}
+}
@@ -2,15 +2,24 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"compress/gzip"
+	"context"
 	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
+	"math/rand"
+	"net"
 	"os"
 	"os/exec"
 	"os/user"
+	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
@@ -19,8 +28,251 @@ import (
 	runewidth "github.com/mattn/go-runewidth"
 )
 
-// Forward slashes are one of the very few characters not allowed in paths
-const delimiter string = "////"
+// Separates the displayed text from the path in fzf's input. NUL can't be in a
+// path or a tag, and terminals don't show it.
+const delimiter = "\x00"
+
+// fzf takes --delimiter as a regular expression, and arguments can't hold NUL
+const delimiterPattern = `\x00`
+
+// Matches the source label at the start of a line, labels can't contain
+// whitespace
+const sourcePattern = `^\[\S*\] `
+
+var (
+	verbose = flag.Bool("v", false, "Print each track as it is removed or inserted")
+	quiet   = flag.Bool("quiet", false, "Suppress all output other than errors")
+	hscroll = flag.Bool("hscroll", false, "Allow fzf to scroll long lines horizontally")
+
+	compactAlbum = flag.Bool("compact-album", false,
+		"Only show the album on the first of several consecutive tracks from it")
+
+	fresh = flag.Bool("fresh", false,
+		"Refuse to use a database older than MPD's last update unless it is updated first")
+	staleAfter = flag.Duration("stale-after", 0,
+		"With -fresh, also treat the database as stale once it is older than this")
+
+	edit = flag.Bool("edit", false, "Reorder or trim the selection in $EDITOR before queueing it")
+
+	waitForUpdate = flag.Bool("wait", false,
+		"Retry reading the database for a few seconds if an MPD update is in progress")
+
+	playIndex = flag.Int("play-index", -1,
+		"Start playing the Nth (0-based) selected track after queueing, clamped to the selection")
+	playFirst = flag.Bool("play", false,
+		"Start playing the first selected track after queueing, the same as -play-index 0")
+
+	strict = flag.Bool("strict", false,
+		"Treat recoverable problems in the database as fatal errors")
+
+	useCache = flag.Bool("cache", false,
+		"Cache the parsed database, reparsing only when the database changes")
+	cacheDirFlag = flag.String("cache-dir", "",
+		"Directory for -cache, defaults to $XDG_CACHE_HOME/mpd-fzf or ~/.cache/mpd-fzf")
+
+	dumpLines = flag.Bool("dump-lines", false,
+		"Print the lines that would be sent to fzf, including the hidden paths, and exit")
+
+	setBookmark = flag.Bool("set-bookmark", false,
+		"Remember the position of the current song for -at-bookmark and exit")
+	atBookmark = flag.Bool("at-bookmark", false,
+		"Insert after the position saved by -set-bookmark instead of after the current song")
+
+	appendSongs = flag.Bool("add", false,
+		"Append the selection to the end of the queue instead of inserting it after the current song")
+
+	replaceQueue = flag.Bool("replace", false,
+		"Clear the queue and add the selection in its place")
+
+	expandAlbum = flag.Bool("expand-album", false,
+		"Queue the whole album of each selected track, in track order")
+
+	insertMaxPerArtist = flag.Int("insert-max-per-artist", 0,
+		"Only queue the first N selected tracks by each artist")
+
+	dryRun = flag.Bool("dry-run", false,
+		"Print the mpc commands that would change the queue instead of running them")
+
+	budget = flag.Duration("budget", 0,
+		"Only queue as many selected tracks, in order, as play within this long, such as 60m")
+
+	printOnly = flag.Bool("print", false,
+		"Print the selected paths, exactly as MPD knows them, instead of queueing them")
+	shellQuote = flag.Bool("shell-quote", false,
+		"Quote each path printed by -print for a POSIX shell")
+	absolutePaths = flag.Bool("absolute", false,
+		"Print full paths under music_directory from mpd.conf with -print")
+
+	ask = flag.Bool("ask", false,
+		"After selecting, ask whether to insert, append, replace the queue, or print the selection")
+
+	appendIfEmpty = flag.Bool("append-if-empty", false,
+		"If the queue is empty, add the selection and start playing it")
+
+	genre = flag.String("genre", "",
+		"Only show tracks with a genre containing this, ignoring case")
+	notGenre = flag.String("not-genre", "",
+		"Hide tracks with a genre containing this, ignoring case")
+	artist = flag.String("artist", "",
+		"Only show tracks with an artist or album artist containing this, ignoring case")
+	notArtist = flag.String("not-artist", "",
+		"Hide tracks with an artist or album artist containing this, ignoring case")
+	withArt = flag.Bool("with-art", false, "Only show tracks the database says have embedded art")
+	noArt   = flag.Bool("no-art", false, "Only show tracks the database doesn't say have embedded art")
+	showArt = flag.Bool("show-art", false, "Mark tracks that have embedded art with a *")
+
+	forceGzip = flag.Bool("gzip", false, "Always read the database as gzip compressed")
+	noGzip    = flag.Bool("no-gzip", false, "Always read the database as uncompressed text")
+
+	configPath = flag.String("config", "",
+		"Read this MPD config file instead of looking in the usual places")
+
+	dbPath = flag.String("db", "",
+		"Read the database at this path instead of looking for db_file in mpd.conf")
+
+	nulRecords = flag.Bool("nul", false,
+		"The database separates lines with NUL instead of newlines, so names can contain newlines")
+
+	fromStdin = flag.Bool("stdin", false,
+		"Read the database from stdin, such as 'zcat tag_cache | mpd-fzf -stdin'")
+
+	protocol = flag.Bool("protocol", false,
+		"Fetch tracks from the running MPD server instead of reading the database file")
+
+	parseLimit = flag.Int("parse-limit", 0,
+		"Stop parsing after this many tracks, giving an arbitrary subset in database order")
+
+	noTruncate = flag.Bool("no-truncate", false,
+		"Send full lines to fzf and let it fit them to the window, which survives resizes")
+
+	afterCmd = flag.String("after", "",
+		"Run this shell command after the queue is changed, with MPD_FZF_ACTION, MPD_FZF_COUNT, "+
+			"MPD_FZF_REMOVED, and MPD_FZF_SONGS describing what was done")
+
+	notify = flag.Bool("notify", false, "Send a desktop notification with notify-send when done")
+
+	stats     = flag.Bool("stats", false, "Print statistics about the library and exit")
+	statsJSON = flag.Bool("stats-json", false, "Print statistics about the library as JSON and exit")
+	tree      = flag.Bool("tree", false, "Print the tracks as a tree of directories and exit")
+
+	cleanPaths = flag.Bool("clean-paths", false,
+		"Resolve . and .. and repeated slashes in paths before comparing or queueing them")
+
+	untagged = &untaggedFlag{}
+
+	preserveOrder = flag.Bool("preserve-order", false,
+		"Queue the selection in the order it was listed in fzf. "+
+			"By default it is queued in the order fzf prints it, which depends on the fzf version")
+
+	mpdHostFlag = flag.String("host", "",
+		"The MPD server to queue on, overriding $MPD_HOST. The database still has to be that server's")
+	mpdPortFlag = flag.String("port", "", "The port of the MPD server, overriding $MPD_PORT")
+
+	mpcBinary = flag.String("mpc", "",
+		"The mpc executable to run, defaults to $MPD_FZF_MPC or mpc from $PATH")
+
+	mpcTimeout = flag.Duration("mpc-timeout", 30*time.Second,
+		"Kill mpc commands that take longer than this, 0 to wait forever")
+
+	showSize = flag.Bool("show-size", false,
+		"Show the size of each file, which needs music_directory from mpd.conf")
+
+	filterQuery = flag.String("filter", "",
+		"Act on the tracks matching this fzf query without showing the picker")
+	maxResults = flag.Int("max-results", 0,
+		"With -filter, only act on this many of the best matches, 0 for all of them")
+
+	fzfBinary = flag.String("fzf", "",
+		"The fzf executable to run, defaults to fzf-tmux inside tmux and fzf otherwise")
+
+	extraFzfArgs = flag.String("fzf-args", "",
+		"Extra whitespace separated arguments for fzf. Arguments after -- are passed on as well")
+
+	colorScheme = flag.String("color-scheme", "",
+		"fzf color scheme, such as dark, light, 16, bw, or a full --color spec")
+
+	validateDb = flag.Bool("validate", false,
+		"Report problems with the database and exit, with a failing status under -strict")
+
+	setRandom  = flag.String("set-random", "", "Turn random playback on or off after queueing")
+	setConsume = flag.String("set-consume", "", "Turn consume mode on or off after queueing")
+	setSingle  = flag.String("set-single", "", "Turn single mode on, off, or once after queueing")
+
+	sortBy = flag.String("sort-by", "",
+		"Sort by these comma separated fields in order, such as albumartist,album,disc,track")
+
+	sinceLast = flag.Bool("since-last", false,
+		"Only show tracks modified since a selection was last queued or printed")
+	sinceLastFirst = flag.String("since-last-first", "all",
+		"What -since-last shows before anything has been queued, all or none")
+
+	recent = flag.Int("recent", 0,
+		"Only show the N most recently added or modified tracks, newest first")
+
+	noGroup = flag.Bool("no-group", false, "Show tracks in database order instead of grouping them")
+
+	shuffleSeed = flag.Int64("seed", 0,
+		"Seed for the order groups of tracks are shown in, 0 for a different order every run")
+
+	byAlbum = flag.Bool("album", false,
+		"Keep the tracks of each album together, in disc and track order")
+
+	groupByDir = flag.Bool("group-by-dir", false,
+		"Keep the tracks in each directory together instead of the tracks by each artist")
+
+	lineFormat = flag.String("format", "",
+		"Show tracks with this template, such as '{artist} - {title} [{album}] {time}', "+
+			"instead of the default layout")
+
+	searchFields = flag.String("search-fields", "",
+		"Only let fzf match these comma separated fields, out of artist, title, album, and time")
+
+	tracksFile = flag.String("tracks-file", "",
+		"Only show the tracks listed in this file, one MPD path per line, in its order")
+)
+
+// -untagged can be given alone or with a list of fields
+type untaggedFlag struct {
+	fields []string
+}
+
+func (u *untaggedFlag) String() string {
+	return strings.Join(u.fields, ",")
+}
+
+func (u *untaggedFlag) Set(value string) error {
+	switch value {
+	case "true":
+		value = "artist,title,album"
+	case "false":
+		value = ""
+	}
+	fields, err := parseFields(value)
+	u.fields = fields
+	return err
+}
+
+func (u *untaggedFlag) IsBoolFlag() bool {
+	return true
+}
+
+func init() {
+	flag.BoolVar(appendSongs, "a", false, "Shorthand for -add")
+	flag.BoolVar(replaceQueue, "r", false, "Shorthand for -replace")
+	flag.BoolVar(playFirst, "p", false, "Shorthand for -play")
+	flag.BoolVar(printOnly, "o", false, "Shorthand for -print")
+	flag.Var(untagged, "untagged",
+		"Only show tracks missing any of these fields, artist,title,album by default")
+}
+
+func missingField(t *Track, fields []string) bool {
+	for _, f := range fields {
+		if v, _ := t.Field(f); v == "" {
+			return true
+		}
+	}
+	return false
+}
 
 func fail(err error) {
 	if err != nil {
@@ -34,11 +286,73 @@ func failOn(b bool, message string) {
 	}
 }
 
+// Informational output on stderr, suppressed by -quiet
+func info(format string, a ...interface{}) {
+	if !*quiet {
+		fmt.Fprintf(os.Stderr, format+"\n", a...)
+	}
+}
+
+// Detailed output on stderr, only shown with -v
+func debug(format string, a ...interface{}) {
+	if *verbose && !*quiet {
+		fmt.Fprintf(os.Stderr, format+"\n", a...)
+	}
+}
+
+// Asks a question on the controlling terminal, since stdin and stdout may
+// belong to fzf or a pipe.
+func prompt(question string) (string, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return "", err
+	}
+	defer tty.Close()
+
+	fmt.Fprint(tty, question)
+	line, err := bufio.NewReader(tty).ReadString('\n')
+	if err == io.EOF && line != "" {
+		err = nil
+	}
+	return strings.TrimSpace(line), err
+}
+
+func confirm(question string) bool {
+	answer, err := prompt(question + " [y/N] ")
+	if err != nil {
+		return false
+	}
+	answer = strings.ToLower(answer)
+	return answer == "y" || answer == "yes"
+}
+
+var (
+	// With -validate anomalies are collected for the report instead
+	collectAnomalies bool
+	anomalies        []string
+)
+
+// Reports a problem in the database that can be worked around, or exits with
+// -strict.
+func anomaly(line int, format string, a ...interface{}) {
+	msg := fmt.Sprintf("Database line %d: %s", line, fmt.Sprintf(format, a...))
+	if collectAnomalies {
+		anomalies = append(anomalies, msg)
+		return
+	}
+	failOn(*strict, msg)
+	info("Warning: %s", msg)
+}
+
 func keyval(line string) (string, string) {
 	i := strings.Index(line, ":")
-	if i == -1 || i == len(line)-1 {
+	if i == -1 {
 		return line, ""
 	}
+	if i == len(line)-1 {
+		// A key with an empty value
+		return line[:i], ""
+	}
 	return line[:i], line[i+2:]
 }
 
@@ -46,12 +360,30 @@ type Track struct {
 	Album       string
 	Artist      string
 	AlbumArtist string
+	Composer    string
+	Performer   string
 	Date        string
 	Filename    string
-	Genre       string
+	Genres      []string
 	Path        string
 	Time        string
+	Duration    time.Duration
 	Title       string
+	Modified    time.Time
+	Disc        int
+	TrackNo     int
+
+	// From databases that note embedded artwork, false when they don't
+	HasArt bool
+
+	// Only known with -metadata-source
+	OriginalYear string
+	AcoustID     string
+
+	// Set for tracks read with -db-file
+	source *dbSource
+	// Set once the more precise duration key is seen
+	fromDuration bool
 }
 
 func (t *Track) Set(key, value string) {
@@ -71,15 +403,131 @@ func (t *Track) Set(key, value string) {
 		if len(value) < 40 {
 			t.AlbumArtist = value
 		}
+	case "Composer":
+		t.Composer = value
+	case "Performer":
+		// Repeated for each performer, like Genre
+		if t.Performer == "" {
+			t.Performer = value
+		} else {
+			t.Performer += "; " + value
+		}
 	case "Date":
 		t.Date = value
 	case "Genre":
-		t.Genre = value
+		// Multiple genres are stored as repeated tags
+		t.Genres = append(t.Genres, value)
 	case "Time":
+		if t.fromDuration {
+			break
+		}
 		t.Time = formatDurationString(value)
+		if secs, err := strconv.Atoi(value); err == nil {
+			t.Duration = time.Duration(secs) * time.Second
+		}
+	case "duration":
+		// Newer versions of MPD write fractional seconds, which win over Time
+		secs, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			break
+		}
+		whole := int(math.Round(secs))
+		t.fromDuration = true
+		t.Duration = time.Duration(whole) * time.Second
+		t.Time = formatDurationString(strconv.Itoa(whole))
 	case "Title":
 		t.Title = value
+	case "Picture", "Artwork":
+		t.HasArt = value != "" && value != "0" && value != "false"
+	case "Disc":
+		t.Disc = leadingNumber(value)
+	case "Track":
+		t.TrackNo = leadingNumber(value)
+	case "mtime":
+		// The database keeps a unix timestamp
+		if secs, err := strconv.ParseInt(value, 10, 64); err == nil {
+			t.Modified = time.Unix(secs, 0)
+		}
+	case "Last-Modified":
+		// The protocol sends the same time formatted
+		if m, err := time.Parse(time.RFC3339, value); err == nil {
+			t.Modified = m
+		}
+	}
+}
+
+func (t *Track) Genre() string {
+	return strings.Join(t.Genres, "; ")
+}
+
+// Reads the 7 from tags like "7" or "7/12", 0 if there's no number
+func leadingNumber(value string) int {
+	end := 0
+	for end < len(value) && value[end] >= '0' && value[end] <= '9' {
+		end++
 	}
+	n, _ := strconv.Atoi(value[:end])
+	return n
+}
+
+func numberField(n int) string {
+	if n == 0 {
+		return ""
+	}
+	return strconv.Itoa(n)
+}
+
+// Looks up a field by its lowercase name, for flags that take field lists
+func (t *Track) Field(name string) (string, bool) {
+	switch name {
+	case "acoustid":
+		return t.AcoustID, true
+	case "album":
+		return t.Album, true
+	case "albumartist":
+		return t.AlbumArtist, true
+	case "artist":
+		return t.Artist, true
+	case "composer":
+		return t.Composer, true
+	case "date":
+		return t.Date, true
+	case "disc":
+		return numberField(t.Disc), true
+	case "filename":
+		return t.Filename, true
+	case "genre":
+		return t.Genre(), true
+	case "originalyear":
+		return t.OriginalYear, true
+	case "path":
+		return t.Path, true
+	case "performer":
+		return t.Performer, true
+	case "time":
+		return t.Time, true
+	case "title":
+		return t.Title, true
+	case "track":
+		return numberField(t.TrackNo), true
+	}
+	return "", false
+}
+
+// Parses a comma separated list of names accepted by Track.Field
+func parseFields(list string) ([]string, error) {
+	fields := []string{}
+	for _, f := range strings.Split(list, ",") {
+		f = strings.ToLower(strings.TrimSpace(f))
+		if f == "" {
+			continue
+		}
+		if _, ok := (&Track{}).Field(f); !ok {
+			return nil, fmt.Errorf("Unknown field '%s'", f)
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
 }
 
 func formatDurationString(str string) string {
@@ -87,12 +535,13 @@ func formatDurationString(str string) string {
 	if err != nil {
 		return ""
 	}
-	zero := time.Time{}
-	format := zero.Add(duration).Format("04:05")
-	if duration > time.Hour {
-		format = fmt.Sprintf("%d:%s", int(duration.Hours()), format)
+	// Formatting as a time of day would wrap after 24 hours
+	secs := int(duration / time.Second)
+	hours, mins, secs := secs/3600, secs/60%60, secs%60
+	if hours > 0 {
+		return fmt.Sprintf("(%d:%02d:%02d)", hours, mins, secs)
 	}
-	return "(" + format + ")"
+	return fmt.Sprintf("(%02d:%02d)", mins, secs)
 }
 
 func withoutExt(path string) string {
@@ -100,13 +549,99 @@ func withoutExt(path string) string {
 	return strings.TrimSuffix(basename, filepath.Ext(basename))
 }
 
+// From mpd.conf, empty if unknown
+var musicDir string
+
+var fileSizes = map[string]string{}
+
+// Returns a human readable size for the track's file, or "" if it can't be
+// found
+func fileSize(t *Track) string {
+	if musicDir == "" {
+		return ""
+	}
+	if size, ok := fileSizes[t.Path]; ok {
+		return size
+	}
+
+	size := ""
+	if st, err := os.Stat(filepath.Join(musicDir, t.Path)); err == nil {
+		size = humanSize(st.Size())
+	}
+	fileSizes[t.Path] = size
+	return size
+}
+
+func humanSize(n int64) string {
+	const units = "KMGT"
+	if n < 1024 {
+		return fmt.Sprintf("%dB", n)
+	}
+	f, i := float64(n)/1024, 0
+	for f >= 1024 && i < len(units)-1 {
+		f /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f%c", f, units[i])
+}
+
 func truncateAndPad(s string, maxWidth int, suffix string) string {
-	if maxWidth < 0 {
-		panic("suffix length greater than maxWidth chars")
+	if maxWidth <= 0 {
+		return ""
+	}
+	if runewidth.StringWidth(suffix) > maxWidth {
+		// Too narrow to say anything was cut
+		suffix = ""
 	}
 	return runewidth.FillRight(runewidth.Truncate(s, maxWidth, suffix), maxWidth)
 }
 
+// A piece of a -format template, either literal text or a field
+type templatePart struct {
+	text  string
+	field string
+}
+
+var lineTemplate []templatePart
+
+// Splits a template like "{artist} - {title}" into parts, checking every
+// placeholder names a field
+func parseTemplate(tmpl string) ([]templatePart, error) {
+	parts := []templatePart{}
+	for tmpl != "" {
+		start := strings.Index(tmpl, "{")
+		if start == -1 {
+			parts = append(parts, templatePart{text: tmpl})
+			break
+		}
+		end := strings.Index(tmpl[start:], "}")
+		if end == -1 {
+			return nil, errors.New("Unclosed '{' in -format")
+		}
+		end += start
+		name := strings.ToLower(tmpl[start+1 : end])
+		if _, ok := (&Track{}).Field(name); !ok {
+			return nil, fmt.Errorf("Unknown field '{%s}' in -format", name)
+		}
+		parts = append(parts, templatePart{text: tmpl[:start]}, templatePart{field: name})
+		tmpl = tmpl[end+1:]
+	}
+	return parts, nil
+}
+
+func renderTemplate(parts []templatePart, t *Track) string {
+	var b strings.Builder
+	for _, p := range parts {
+		if p.field == "" {
+			b.WriteString(p.text)
+		} else {
+			v, _ := t.Field(p.field)
+			b.WriteString(v)
+		}
+	}
+	return b.String()
+}
+
 func trackFormatter() func(*Track) string {
 	var width, ignored int
 	// tmux pane_width > $COLUMNS > stty size > default 80
@@ -135,6 +670,8 @@ func trackFormatter() func(*Track) string {
 	}
 
 	contentLen := width - 5 // remove 5 for fzf display
+	// The album of the previous line, for -compact-album
+	var prevAlbum string
 	return func(t *Track) string {
 		name := t.Title
 		if t.Title == "" {
@@ -142,34 +679,164 @@ func trackFormatter() func(*Track) string {
 		}
 
 		str := name
+		// The same pieces, kept apart for -search-fields
+		artist, title := "", name
 
 		// TODO -- Some kind of column formatting? If the terminal is wide?
 		if t.AlbumArtist != "" && t.Artist != "" && t.AlbumArtist != t.Artist {
 			str = t.AlbumArtist + " - " + name + " // " + t.Artist
+			artist, title = t.AlbumArtist, "- "+name+" // "+t.Artist
 		} else if t.AlbumArtist != "" {
 			str = t.AlbumArtist + " - " + name
+			artist, title = t.AlbumArtist, "- "+name
 		} else if t.Artist != "" {
 			str = t.Artist + " - " + name
+			artist, title = t.Artist, "- "+name
 		}
 
-		if t.Album != "" {
-			str += " {" + t.Album + "}"
+		album := t.Album
+		if *compactAlbum {
+			key := artistKey(t) + delimiter + t.Album
+			if key == prevAlbum {
+				album = ""
+			}
+			prevAlbum = key
+		}
+
+		if album != "" {
+			album = "{" + album + "}"
+			if t.Title == "" && t.Artist == "" && t.AlbumArtist == "" {
+				// The album is more recognizable than a bare filename
+				str = album + " - " + name
+			} else {
+				str += " " + album
+			}
+		}
+		prefix := ""
+		if *showSource && t.source != nil {
+			prefix = "[" + t.source.Label + "] "
+		}
+		if *showArt {
+			if t.HasArt {
+				prefix += "* "
+			} else {
+				prefix += "  "
+			}
+		}
+		suffix := t.Time
+		if len(lineTemplate) > 0 {
+			// The template places the time itself, if it wants it
+			str, suffix = renderTemplate(lineTemplate, t), ""
+		}
+		if *showSize {
+			suffix = fmt.Sprintf("%7s ", fileSize(t)) + suffix
+		}
+
+		if len(searchLayout) > 0 {
+			return fieldLine(prefix, []string{artist, title, album}, suffix, contentLen, t.Path)
+		}
+		if *noTruncate {
+			// fzf hides the path itself, see fzfSongs
+			return prefix + str + " " + suffix + delimiter + t.Path
+		}
+		str = truncateAndPad(str, contentLen-runewidth.StringWidth(suffix)-runewidth.StringWidth(prefix), "..")
+		return prefix + str + suffix + delimiter + t.Path
+	}
+}
+
+// The n most recently modified tracks, newest first
+func recentTracks(tracks []*Track, n int) []*Track {
+	sorted := append([]*Track{}, tracks...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Modified.After(sorted[j].Modified)
+	})
+	if len(sorted) > n {
+		sorted = sorted[:n]
+	}
+	return sorted
+}
 
+// The fields from -sort-by
+var sortFields []string
+
+// Sorts by each field in turn, comparing numbers as numbers. Fields that are
+// missing sort first.
+func sortTracks(tracks []*Track, fields []string) {
+	sort.SliceStable(tracks, func(i, j int) bool {
+		for _, f := range fields {
+			a, _ := tracks[i].Field(f)
+			b, _ := tracks[j].Field(f)
+			if c := compareValues(a, b); c != 0 {
+				return c < 0
+			}
 		}
-		str = truncateAndPad(str, contentLen-len(t.Time), "..")
-		return str + t.Time + delimiter + t.Path
+		return false
+	})
+}
+
+func compareValues(a, b string) int {
+	x, errA := strconv.Atoi(a)
+	y, errB := strconv.Atoi(b)
+	if errA == nil && errB == nil {
+		return x - y
+	}
+	return strings.Compare(strings.ToLower(a), strings.ToLower(b))
+}
+
+// Groups by artist, by directory with -group-by-dir, or by album in track
+// order with -album. -no-group leaves the database order alone.
+func groupTracks(tracks []*Track) []*Track {
+	if *noGroup {
+		return tracks
+	}
+	if *groupByDir {
+		return groupBy(tracks, func(t *Track) string { return path.Dir(t.Path) }, nil)
 	}
+	if *byAlbum {
+		return groupBy(tracks, func(t *Track) string { return artistKey(t) + delimiter + t.Album },
+			albumOrder)
+	}
+	// Compilations stay together under their album artist
+	return groupBy(tracks, artistKey, nil)
+}
+
+// Whether a comes before b on their album
+func albumOrder(a, b *Track) bool {
+	if a.Disc != b.Disc {
+		return a.Disc < b.Disc
+	}
+	return a.TrackNo < b.TrackNo
 }
 
-func groupByArtist(tracks []*Track) []*Track {
-	// group by artist, then shuffle to stop same order, but keep artist together
-	artists := map[string][]*Track{}
+// Groups by key and shuffles the groups, so the same artists aren't always at
+// the bottom, but keeps each group together. Sorts each group with less, or
+// leaves it in database order if less is nil. -seed makes the order repeatable.
+func groupBy(tracks []*Track, key func(*Track) string, less func(a, b *Track) bool) []*Track {
+	groups := map[string][]*Track{}
+	keys := []string{}
 	for _, t := range tracks {
-		artists[t.Artist] = append(artists[t.Artist], t)
+		k := key(t)
+		if _, ok := groups[k]; !ok {
+			keys = append(keys, k)
+		}
+		groups[k] = append(groups[k], t)
+	}
+
+	seed := *shuffleSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
 	}
+	// keys is in database order, so a seed always gives the same shuffle
+	rng := rand.New(rand.NewSource(seed))
+	rng.Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+
 	shuffled := make([]*Track, len(tracks))
 	i := 0
-	for _, tracks := range artists {
+	for _, k := range keys {
+		tracks := groups[k]
+		if less != nil {
+			sort.SliceStable(tracks, func(i, j int) bool { return less(tracks[i], tracks[j]) })
+		}
 		for _, t := range tracks {
 			shuffled[i] = t
 			i += 1
@@ -178,86 +845,466 @@ func groupByArtist(tracks []*Track) []*Track {
 	return shuffled
 }
 
-func parse(scan *bufio.Scanner) []*Track {
-	tracks, track := []*Track{}, new(Track)
-	dirs := []string{}
+func filterTracks(tracks []*Track, keep func(*Track) bool) []*Track {
+	filtered := []*Track{}
+	for _, t := range tracks {
+		if keep(t) {
+			filtered = append(filtered, t)
+		}
+	}
+	return filtered
+}
 
-	for scan.Scan() {
-		key, value := keyval(scan.Text())
-		switch key {
-		case "directory":
-			dirs = append(dirs, value)
-		case "end":
-			failOn(len(dirs) <= 0, "Invalid directory state. Corrupted database?")
-			dirs = dirs[:len(dirs)-1]
-		case "Artist", "Album", "AlbumArtist", "Date", "Genre", "Time", "Title":
-			track.Set(key, value)
-		case "song_begin":
-			track.Filename = value
-			track.Path = filepath.Join(append(dirs, track.Filename)...)
-		case "song_end":
-			tracks = append(tracks, track)
-			track = new(Track)
+func containsFold(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
+
+func hasGenre(t *Track, genre string) bool {
+	for _, g := range t.Genres {
+		if containsFold(g, genre) {
+			return true
 		}
 	}
-	fail(scan.Err())
-	return tracks
+	return false
+}
+
+func hasArtist(t *Track, artist string) bool {
+	return containsFold(t.Artist, artist) || containsFold(t.AlbumArtist, artist)
 }
 
-func expandUser(path, home string) string {
-	if path[:2] == "~/" {
-		path = strings.Replace(path, "~", home, 1)
+// A track is shown if it passes every positive filter and fails every
+// negative one
+func matchesFilters(t *Track) bool {
+	switch {
+	case *genre != "" && !hasGenre(t, *genre):
+		return false
+	case *artist != "" && !hasArtist(t, *artist):
+		return false
+	case *notGenre != "" && hasGenre(t, *notGenre):
+		return false
+	case *notArtist != "" && hasArtist(t, *notArtist):
+		return false
+	case *withArt && !t.HasArt, *noArt && t.HasArt:
+		return false
 	}
-	return path
+	return true
 }
 
-func findDbFile() string {
-	usr, err := user.Current()
-	fail(err)
-	home := usr.HomeDir
-	paths := []string{
-		filepath.Join(os.Getenv("XDG_CONFIG_HOME"), "/mpd/mpd.conf"),
-		filepath.Join(home, ".config", "/mpd/mpd.conf"),
-		filepath.Join(home, ".mpdconf"),
-		"/etc/mpd.conf",
-		"/usr/local/etc/musicpd.conf",
+// Drops anything that isn't the path of one of tracks, in case a line came
+// back from fzf mangled, rather than handing it to mpc
+func knownSongs(tracks []*Track, songs []string) []string {
+	known := make(map[string]bool, len(tracks))
+	for _, t := range tracks {
+		known[t.Path] = true
 	}
-	var f *os.File
-	var confpath string
-	for _, path := range paths {
-		f, err = os.Open(path)
-		if err == nil {
-			confpath = path
-			break
+	kept := []string{}
+	for _, s := range songs {
+		if known[s] {
+			kept = append(kept, s)
+		} else {
+			info("Warning: skipping '%s' from fzf, which isn't a track in the database", s)
 		}
 	}
-	failOn(f == nil, "No config file found")
+	return kept
+}
+
+// Sorts songs into the order their tracks appear in
+func displayOrder(tracks []*Track, songs []string) []string {
+	position := make(map[string]int, len(tracks))
+	for i, t := range tracks {
+		if _, ok := position[t.Path]; !ok {
+			position[t.Path] = i
+		}
+	}
+	sorted := append([]string{}, songs...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return position[sorted[i]] < position[sorted[j]]
+	})
+	return sorted
+}
+
+// Restricts tracks to the paths listed in a file, in the order they are listed
+func tracksFromFile(tracks []*Track, file string) []*Track {
+	byPath := make(map[string]*Track, len(tracks))
+	for _, t := range tracks {
+		byPath[t.Path] = t
+	}
 
-	expDb := regexp.MustCompile(`^\s*db_file\s*"([^"]+)"`)
+	f, err := os.Open(file)
+	fail(err)
+	listed := []*Track{}
 	scan := bufio.NewScanner(f)
-	var dbFile string
 	for scan.Scan() {
-		m := expDb.FindStringSubmatch(scan.Text())
-		if m != nil {
-			dbFile = expandUser(m[1], home)
+		path := strings.TrimSpace(scan.Text())
+		if path != "" {
+			path = canonicalPath(path)
+		}
+		if path == "" {
+			continue
+		}
+		if t, ok := byPath[path]; ok {
+			listed = append(listed, t)
+		} else {
+			info("Not in the database: %s", path)
 		}
 	}
 	fail(scan.Err())
 	fail(f.Close())
-	failOn(dbFile == "", fmt.Sprintf("Could not find 'db_file' in configuration file '%s'", confpath))
-	return dbFile
+	return listed
 }
 
-func fzfCheckExit(err error) {
-	if err != nil {
-		if exerr, ok := err.(*exec.ExitError); ok {
-			if status, ok := exerr.Sys().(syscall.WaitStatus); ok {
-				// FZF returns 130 when killed by ctrl+C
-				if status.ExitStatus() == 130 {
-					os.Exit(0)
-				} else {
-					fail(err)
-				}
+// Database paths are already cleaned by filepath.Join, but listallinfo and
+// user supplied lists hand paths over verbatim
+func canonicalPath(p string) string {
+	if *cleanPaths {
+		return path.Clean(p)
+	}
+	return p
+}
+
+// Parses either the database file or, with protocol set, a listallinfo
+// response. The two formats share tags but mark songs differently: the
+// database wraps them in song_begin/song_end inside nested directories while
+// listallinfo starts each song with its full path and ends the response with
+// OK or ACK.
+//
+// The database's playlist_begin/playlist_end blocks only describe the playlist
+// files in a directory. The songs of a CUE sheet or a container file are stored
+// as a directory named after it, and are read like any other directory.
+func parse(scan *bufio.Scanner, protocol bool) ([]*Track, error) {
+	tracks, track := []*Track{}, new(Track)
+	dirs := []string{}
+	inSong, inFile, skipSong, inPlaylist := false, false, false, false
+	line := 0
+
+	// Nothing but tags belongs in a playlist block, so anything else closes it
+	endPlaylist := func() {
+		if inPlaylist {
+			anomaly(line, "'playlist_begin' without a matching 'playlist_end'")
+		}
+		inPlaylist = false
+	}
+
+	// listallinfo songs have no end marker, they run until the next entry
+	endFile := func() {
+		if inFile {
+			tracks = append(tracks, track)
+			track = new(Track)
+		}
+		inFile = false
+	}
+
+	// A database cut short, by a crash during an update for instance, can stop
+	// in the middle of a song. Anything that isn't a tag means the song_end was
+	// lost, but the song is still worth keeping once it has a path.
+	endSong := func(where string) {
+		if inSong && !skipSong && track.Filename != "" {
+			anomaly(line, "'song_begin' without a matching 'song_end' %s, keeping the record", where)
+			tracks = append(tracks, track)
+		}
+		inSong, skipSong = false, false
+		track = new(Track)
+	}
+
+	for scan.Scan() {
+		if *parseLimit > 0 && len(tracks) >= *parseLimit {
+			return tracks, nil
+		}
+		line++
+		text := scan.Text()
+		if protocol && strings.HasPrefix(text, "ACK ") {
+			return tracks, errors.New("MPD error: " + text)
+		}
+
+		key, value := keyval(text)
+		switch key {
+		case "format":
+			// MPD has only ever written versions 1 and 2
+			if value != "1" && value != "2" {
+				anomaly(line, "unknown database format '%s'", value)
+			}
+		case "directory":
+			if protocol {
+				endFile()
+			} else {
+				endSong("before a directory")
+				endPlaylist()
+				dirs = append(dirs, value)
+			}
+		case "end":
+			endSong("before the end of its directory")
+			endPlaylist()
+			if len(dirs) == 0 {
+				anomaly(line, "'end' without a matching 'directory', ignoring it")
+				continue
+			}
+			dirs = dirs[:len(dirs)-1]
+		case "Artist", "Album", "AlbumArtist", "Date", "Genre", "Time", "Title",
+			"Picture", "Artwork", "Disc", "Track", "duration", "Composer", "Performer":
+			if !inSong && !inFile {
+				// They'd describe a directory or playlist, not the next song
+				continue
+			}
+			isDuration := key == "Time" || key == "duration"
+			if _, err := strconv.ParseFloat(value, 64); isDuration && err != nil {
+				anomaly(line, "unparsable duration '%s'", value)
+			}
+			track.Set(key, value)
+		case "mtime", "Last-Modified":
+			// Directories have them too
+			if inSong || inFile {
+				track.Set(key, value)
+			}
+		case "song_begin":
+			endSong("before the next song")
+			endPlaylist()
+			inSong = true
+			track.Filename = value
+			track.Path = filepath.Join(append(dirs, track.Filename)...)
+			if value == "" {
+				// The path would be the directory itself, which isn't a song
+				anomaly(line, "'song_begin' without a filename, skipping the record")
+				skipSong = true
+			}
+		case "song_end":
+			if skipSong {
+				skipSong = false
+			} else if inSong {
+				tracks = append(tracks, track)
+			} else {
+				anomaly(line, "'song_end' without a matching 'song_begin', skipping the record")
+			}
+			inSong = false
+			track = new(Track)
+		case "playlist_begin":
+			endSong("before a playlist")
+			if inPlaylist {
+				anomaly(line, "'playlist_begin' inside another playlist")
+			}
+			inPlaylist = true
+		case "playlist_end":
+			if !inPlaylist {
+				anomaly(line, "'playlist_end' without a matching 'playlist_begin'")
+			}
+			inPlaylist = false
+		case "file":
+			if protocol {
+				endFile()
+				inFile = true
+				track.Path = canonicalPath(value)
+				track.Filename = filepath.Base(track.Path)
+			}
+		case "playlist":
+			if protocol {
+				endFile()
+			}
+		case "OK":
+			if protocol {
+				endFile()
+				return tracks, nil
+			}
+		}
+	}
+	if !protocol {
+		endSong("at the end of the database")
+		if len(dirs) > 0 {
+			unclosed := make([]string, len(dirs))
+			for i := range dirs {
+				unclosed[i] = "'" + filepath.Join(dirs[:i+1]...) + "'"
+			}
+			anomaly(line, "%s without a matching 'end'", strings.Join(unclosed, ", "))
+		}
+	}
+	if err := scan.Err(); err != nil || !protocol {
+		return tracks, err
+	}
+	return tracks, errors.New("MPD closed the connection unexpectedly")
+}
+
+// Expands $VAR and ${VAR} from the environment. Unset variables are left as
+// written, without braces, so a path that really contains a $ still opens
+// unless the text after it happens to name a variable.
+func expandEnv(path string) string {
+	return os.Expand(path, func(name string) string {
+		if v, ok := os.LookupEnv(name); ok {
+			return v
+		}
+		return "$" + name
+	})
+}
+
+// Expands ~ and ~/ to home, and ~name and ~name/ to the home of that user
+func expandUser(path, home string) (string, error) {
+	if !strings.HasPrefix(path, "~") {
+		return path, nil
+	}
+	name, rest := path[1:], ""
+	if i := strings.Index(name, "/"); i >= 0 {
+		name, rest = name[:i], name[i:]
+	}
+	if name != "" {
+		usr, err := user.Lookup(name)
+		if err != nil {
+			return "", fmt.Errorf("Could not expand '%s': %v", path, err)
+		}
+		home = usr.HomeDir
+	}
+	return home + rest, nil
+}
+
+type mpdConfig struct {
+	Path          string
+	DbFile        string
+	MusicDir      string
+	BindAddresses []string
+	Port          string
+}
+
+func readConfig() *mpdConfig {
+	usr, err := user.Current()
+	fail(err)
+	home := usr.HomeDir
+	paths := []string{
+		filepath.Join(os.Getenv("XDG_CONFIG_HOME"), "/mpd/mpd.conf"),
+		filepath.Join(home, ".config", "/mpd/mpd.conf"),
+		filepath.Join(home, ".mpdconf"),
+		"/etc/mpd.conf",
+		"/usr/local/etc/musicpd.conf",
+	}
+	// Packagers and unusual installs can add their own locations to try first
+	if extra := os.Getenv("MPD_FZF_CONFIG_PATHS"); extra != "" {
+		paths = append(filepath.SplitList(extra), paths...)
+	}
+	var f *os.File
+	conf := &mpdConfig{}
+	if *configPath != "" {
+		f, err = os.Open(*configPath)
+		if err != nil {
+			fail(fmt.Errorf("Could not open config file: %v", err))
+		}
+		conf.Path = *configPath
+		paths = nil
+	}
+	for _, path := range paths {
+		f, err = os.Open(path)
+		if err == nil {
+			conf.Path = path
+			break
+		}
+	}
+	// The server or the user already says where everything is, the config is
+	// only a hint
+	required := !*protocol && !*fromStdin && len(dbSources) == 0 && *dbPath == ""
+	if f == nil && !required {
+		return conf
+	}
+	failOn(f == nil, "No config file found")
+
+	fail(scanConfig(conf, f, home, 0))
+	failOn(conf.DbFile == "" && required, fmt.Sprintf("Could not find 'db_file' in configuration file '%s'", conf.Path))
+	return conf
+}
+
+var (
+	expDb      = regexp.MustCompile(`^\s*db_file\s*"([^"]+)"`)
+	expBind    = regexp.MustCompile(`^\s*bind_to_address\s*"([^"]+)"`)
+	expPort    = regexp.MustCompile(`^\s*port\s*"([^"]+)"`)
+	expMusic   = regexp.MustCompile(`^\s*music_directory\s*"([^"]+)"`)
+	expInclude = regexp.MustCompile(`^\s*(include|include_optional)\s*"([^"]+)"`)
+)
+
+// Deep enough for any real config, shallow enough to stop include cycles
+const maxIncludeDepth = 10
+
+// Reads settings from f and any files it includes into conf, closing f
+func scanConfig(conf *mpdConfig, f *os.File, home string, depth int) error {
+	defer f.Close()
+	var err error
+	scan := bufio.NewScanner(f)
+	for scan.Scan() {
+		line := scan.Text()
+		if m := expInclude.FindStringSubmatch(line); m != nil {
+			if depth >= maxIncludeDepth {
+				return fmt.Errorf("Too many nested includes in '%s'", f.Name())
+			}
+			path, err := expandUser(m[2], home)
+			if err != nil {
+				return err
+			}
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(filepath.Dir(f.Name()), path)
+			}
+			inc, err := os.Open(path)
+			if os.IsNotExist(err) && m[1] == "include_optional" {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if err = scanConfig(conf, inc, home, depth+1); err != nil {
+				return err
+			}
+		} else if m := expDb.FindStringSubmatch(line); m != nil {
+			if conf.DbFile, err = expandUser(expandEnv(m[1]), home); err != nil {
+				return err
+			}
+		} else if m := expBind.FindStringSubmatch(line); m != nil {
+			addr, err := expandUser(m[1], home)
+			if err != nil {
+				return err
+			}
+			conf.BindAddresses = append(conf.BindAddresses, addr)
+		} else if m := expPort.FindStringSubmatch(line); m != nil {
+			conf.Port = m[1]
+		} else if m := expMusic.FindStringSubmatch(line); m != nil {
+			if conf.MusicDir, err = expandUser(m[1], home); err != nil {
+				return err
+			}
+		}
+	}
+	return scan.Err()
+}
+
+// Picks the host and port mpc should use to reach the MPD instance described
+// by the config. MPD can listen on several addresses at once, usually a Unix
+// socket and a TCP address; the socket is preferred since this is run locally.
+func (c *mpdConfig) mpdHost() (string, string) {
+	for _, addr := range c.BindAddresses {
+		// Paths and abstract sockets
+		if strings.HasPrefix(addr, "/") || strings.HasPrefix(addr, "@") {
+			return addr, ""
+		}
+	}
+
+	for _, addr := range c.BindAddresses {
+		host, port := addr, c.Port
+		if h, p, err := net.SplitHostPort(addr); err == nil {
+			host, port = h, p
+		}
+		switch host {
+		case "any", "0.0.0.0", "::", "":
+			host = "localhost"
+		}
+		return host, port
+	}
+	return "", c.Port
+}
+
+func fzfCheckExit(err error) {
+	if err != nil {
+		if exerr, ok := err.(*exec.ExitError); ok {
+			if status, ok := exerr.Sys().(syscall.WaitStatus); ok {
+				// FZF returns 130 when aborted with ctrl+C or Esc. Aborting
+				// always means doing nothing, even if some configurations
+				// still print the marked tracks.
+				if status.ExitStatus() == 130 {
+					os.Exit(0)
+				} else if status.ExitStatus() == 1 {
+					// Nothing matched the query, so nothing was selected
+					return
+				} else {
+					fail(err)
+				}
 			} else {
 				fail(err)
 			}
@@ -282,9 +1329,148 @@ func parseFzfOutput(output []byte) []string {
 	return songs
 }
 
-func fzfSongs(tracks []*Track) []string {
+func writeLines(w io.Writer, tracks []*Track) {
 	format := trackFormatter()
-	fzf := exec.Command("fzf-tmux", "--no-hscroll", "-m")
+	for _, t := range tracks {
+		io.WriteString(w, format(t)+"\n")
+	}
+}
+
+// The fields of each line under -search-fields, in order, separated by tabs
+var searchLayout []string
+
+// Lays out the fields for -search-fields, which fzf can only tell apart by a
+// delimiter. Tabs are shown as single spaces with --tabstop=1, so lines look the
+// same as without it.
+func setSearchLayout() error {
+	fields := []string{}
+	for _, f := range strings.Split(*searchFields, ",") {
+		f = strings.ToLower(strings.TrimSpace(f))
+		switch f {
+		case "":
+		case "artist", "title", "album", "time":
+			fields = append(fields, f)
+		default:
+			return fmt.Errorf("Unknown search field '%s'", f)
+		}
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	if *noTruncate {
+		return errors.New("-search-fields cannot be used with -no-truncate")
+	}
+
+	searchLayout = []string{"artist", "title", "album", "time", "path"}
+	if *showSource || *showArt {
+		searchLayout = append([]string{"prefix"}, searchLayout...)
+	}
+	searchNth = make([]string, len(fields))
+	for i, f := range fields {
+		for j, l := range searchLayout {
+			if f == l {
+				searchNth[i] = strconv.Itoa(j + 1)
+			}
+		}
+	}
+	return nil
+}
+
+// The --nth indices of the fields chosen with -search-fields
+var searchNth []string
+
+// Builds a tab separated line following searchLayout, shortening the fields
+// from the end until they fit in width.
+func fieldLine(prefix string, fields []string, suffix string, width int, path string) string {
+	for i, f := range fields {
+		fields[i] = strings.ReplaceAll(f, "\t", " ")
+	}
+	if searchLayout[0] == "prefix" {
+		// The tab after the prefix takes the place of its trailing space
+		fields = append([]string{strings.TrimSuffix(prefix, " ")}, fields...)
+	}
+
+	// Every tab but the one before the path is shown as a column
+	budget := width - runewidth.StringWidth(suffix) - len(fields)
+	used := 0
+	for _, f := range fields {
+		used += runewidth.StringWidth(f)
+	}
+	for i := len(fields) - 1; i >= 0 && used > budget; i-- {
+		w := runewidth.StringWidth(fields[i])
+		keep := w - (used - budget)
+		if keep <= 2 {
+			fields[i] = ""
+		} else {
+			fields[i] = runewidth.Truncate(fields[i], keep, "..")
+		}
+		used -= w - runewidth.StringWidth(fields[i])
+	}
+	if used < budget {
+		fields[len(fields)-1] += strings.Repeat(" ", budget-used)
+	}
+	return strings.Join(fields, "\t") + "\t" + suffix + "\t" + delimiter + path
+}
+
+// Arguments for an fzf picking from formatted tracks
+func trackFzfArgs() []string {
+	args := []string{"-m"}
+	if !*hscroll {
+		args = append(args, "--no-hscroll")
+	}
+	if len(searchNth) > 0 {
+		args = append(args, "--delimiter=\t", "--tabstop=1", "--nth="+strings.Join(searchNth, ","))
+	} else if *noTruncate && *showSource && len(dbSources) > 0 {
+		// The label becomes its own field so it can be left out of the search.
+		// --nth counts the fields of what --with-nth leaves.
+		args = append(args, "--delimiter="+sourcePattern+"|"+delimiterPattern, "--with-nth=..2", "--nth=2")
+	} else if *noTruncate {
+		// Nothing pads the path out of view, so only display what's before it
+		args = append(args, "--delimiter="+delimiterPattern, "--with-nth=1")
+	} else if *showSource && len(dbSources) > 0 {
+		// Search everything but the source label
+		args = append(args, "--nth=2..")
+	}
+	return args
+}
+
+// The fzf executable, found the first time it's needed
+var fzfPath string
+
+// Uses -fzf if it was given. Otherwise uses fzf-tmux inside tmux, except with
+// -filter since there's nothing to display, and fzf everywhere else.
+func findFzf() string {
+	if fzfPath != "" {
+		return fzfPath
+	}
+	names := []string{"fzf"}
+	if *fzfBinary != "" {
+		names = []string{*fzfBinary}
+	} else if os.Getenv("TMUX") != "" && *filterQuery == "" {
+		names = []string{"fzf-tmux", "fzf"}
+	}
+	for _, name := range names {
+		if path, err := exec.LookPath(name); err == nil {
+			fzfPath = path
+			return fzfPath
+		}
+	}
+	fail(fmt.Errorf("%s not found in $PATH; install fzf to pick songs, or point -fzf at it",
+		strings.Join(names, " or ")))
+	return ""
+}
+
+// Runs fzf with input from write and returns its output. Exits if fzf was
+// aborted.
+func runFzf(args []string, write func(io.Writer)) []byte {
+	bin := findFzf()
+	if *colorScheme != "" {
+		args = append(args, "--color="+*colorScheme)
+	}
+	// Last, so they can override anything set above
+	args = append(args, strings.Fields(*extraFzfArgs)...)
+	args = append(args, flag.Args()...)
+	fzf := exec.Command(bin, args...)
 	fzf.Stderr = os.Stderr
 
 	in, err := fzf.StdinPipe()
@@ -292,94 +1478,1059 @@ func fzfSongs(tracks []*Track) []string {
 	out, err := fzf.StdoutPipe()
 	fail(err)
 	fail(fzf.Start())
-	for _, t := range tracks {
-		fmt.Fprintln(in, format(t))
+	// A write per line is most of the time it takes fzf to get a big library
+	buf := bufio.NewWriterSize(in, 64*1024)
+	write(buf)
+	// fzf stops reading if something is picked before it has every line
+	if err := buf.Flush(); err != nil && !errors.Is(err, syscall.EPIPE) {
+		fail(err)
 	}
 	fail(in.Close())
 	fzfOutput, err := ioutil.ReadAll(out)
 	fail(err)
-	fzfCheckExit(fzf.Wait())
+	err = fzf.Wait()
+	for _, f := range fzfTempFiles {
+		os.Remove(f)
+	}
+	fzfTempFiles = nil
+	// Exits before anything from an aborted fzf is looked at
+	fzfCheckExit(err)
+
+	return fzfOutput
+}
+
+func fzfSongs(tracks []*Track) []string {
+	args := trackFzfArgs()
+	if *filterQuery != "" {
+		args = append(args, "--filter="+*filterQuery)
+	} else if *showPreview {
+		args = append(args, previewArgs(tracks)...)
+	}
+	songs := parseFzfOutput(runFzf(args, func(w io.Writer) {
+		writeLines(w, tracks)
+	}))
 
-	return parseFzfOutput(fzfOutput)
+	// --filter prints the best matches first
+	if *filterQuery != "" && *maxResults > 0 && len(songs) > *maxResults {
+		info("Only using %d of %d matches", *maxResults, len(songs))
+		songs = songs[:*maxResults]
+	}
+	return songs
 }
 
-func removeSongs(songs []string) error {
-	fnames := make(map[string]struct{})
+// Lets the user reorder or delete songs in their editor. Blank lines and
+// lines starting with # are ignored.
+func editSongs(songs []string) ([]string, error) {
+	f, err := ioutil.TempFile("", "mpd-fzf-*.txt")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+
+	fmt.Fprintln(f, "# Reorder or delete songs, the remaining songs will be queued in this order")
 	for _, s := range songs {
-		if s != "" {
-			fnames[s] = struct{}{}
-		}
+		fmt.Fprintln(f, s)
 	}
-	mpc := exec.Command("mpc", "playlist", "-f", `%position% %file%`)
-	out, err := mpc.Output()
+	if err = f.Close(); err != nil {
+		return nil, err
+	}
+
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+	}
+
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer tty.Close()
 
-	mpc = exec.Command("mpc", "del")
-	in, _ := mpc.StdinPipe()
-	if err = mpc.Start(); err != nil {
-		in.Close()
-		return err
+	// Run through the shell so EDITOR can contain arguments
+	cmd := exec.Command("sh", "-c", editor+` "$1"`, "sh", f.Name())
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = tty, tty, tty
+	if err = cmd.Run(); err != nil {
+		return nil, fmt.Errorf("Editor exited abnormally, aborting: %v", err)
 	}
 
-	for _, s := range strings.Split(string(out), "\n") {
-		posFname := strings.SplitN(s, " ", 2)
-		if len(posFname) == 1 {
+	contents, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		return nil, err
+	}
+	edited := []string{}
+	for _, line := range strings.Split(string(contents), "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
 			continue
 		}
-		if _, ok := fnames[posFname[1]]; ok {
-			fmt.Fprintln(in, posFname[0])
-		}
+		edited = append(edited, line)
+	}
+	return edited, nil
+}
+
+func plural(n int, noun string) string {
+	if n == 1 {
+		return fmt.Sprintf("%d %s", n, noun)
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
+
+// Extra environment for every mpc invocation
+var mpcEnv []string
+
+// The environment pointing mpc at the server from mpd.conf
+var configMpcEnv []string
+
+// Points mpc at the server from the MPD config unless the user has already
+// chosen one through the environment.
+func setMpcHost(conf *mpdConfig) {
+	if os.Getenv("MPD_HOST") != "" || os.Getenv("MPD_PORT") != "" {
+		return
+	}
+	host, port := conf.mpdHost()
+	if host != "" {
+		configMpcEnv = append(configMpcEnv, "MPD_HOST="+host)
+	}
+	if port != "" {
+		configMpcEnv = append(configMpcEnv, "MPD_PORT="+port)
 	}
+	mpcEnv = configMpcEnv
+}
+
+// A context that kills mpc commands after -mpc-timeout, since mpc can wait
+// indefinitely on an unreachable server
+func mpcContext() (context.Context, context.CancelFunc) {
+	if *mpcTimeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), *mpcTimeout)
+}
+
+// Explains errors from mpc commands killed by mpcContext
+func mpcError(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("MPD not responding, gave up on mpc after %s", *mpcTimeout)
+	}
+	return err
+}
+
+// The mpc executable, found the first time it's needed
+var mpcPath string
+
+func findMpc() string {
+	if mpcPath != "" {
+		return mpcPath
+	}
+	name := *mpcBinary
+	if name == "" {
+		name = os.Getenv("MPD_FZF_MPC")
+	}
+	if name == "" {
+		name = "mpc"
+	}
+	path, err := exec.LookPath(name)
+	if err != nil {
+		fail(fmt.Errorf("%s not found in $PATH; install the MPD client to queue songs, "+
+			"or point -mpc or $MPD_FZF_MPC at it", name))
+	}
+	mpcPath = path
+	return mpcPath
+}
 
-	if err = in.Close(); err != nil {
-		return err
+func mpcCommand(ctx context.Context, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, findMpc(), args...)
+	if len(mpcEnv) > 0 {
+		cmd.Env = append(os.Environ(), mpcEnv...)
 	}
-	return mpc.Wait()
+	return cmd
 }
 
-func insertSongs(songs []string) error {
-	mpc := exec.Command("mpc", "insert")
+// Feeds songs to an mpc command that reads them from stdin, returning the
+// number of songs queued. mpc sends them all as one command list, which MPD
+// abandons at the first song it rejects, so the songs after that one are sent
+// again without it.
+func queueSongs(command string, songs []string) (int, error) {
+	queued := 0
+	for {
+		rejected, err := runQueueCommand(command, songs)
+		if rejected < 0 {
+			return queued + len(songs), err
+		}
+		// Usually removed since the database was read
+		queued += rejected
+		failedSongs = append(failedSongs, songs[rejected])
+		songs = songs[rejected+1:]
+		if err != nil || len(songs) == 0 {
+			return queued, err
+		}
+	}
+}
+
+// Songs mpc couldn't queue, reported in the summary
+var failedSongs []string
+
+// Runs a single mpc command for queueSongs, returning the index of the song
+// MPD rejected, or -1 if it took them all. Nothing after that song was queued.
+func runQueueCommand(command string, songs []string) (int, error) {
+	ctx, cancel := mpcContext()
+	defer cancel()
+	mpc := mpcCommand(ctx, command)
+	var stderr bytes.Buffer
+	mpc.Stderr = &stderr
 	in, _ := mpc.StdinPipe()
 	if err := mpc.Start(); err != nil {
 		in.Close()
-		return err
+		return -1, err
 	}
 
 	// Reverse order isn't required when adding a bunch of songs from stdin
 	for _, s := range songs {
+		debug("Queueing %s", s)
 		fmt.Fprintln(in, s)
 	}
 
 	if err := in.Close(); err != nil {
-		return err
+		return -1, err
+	}
+	err := mpcError(ctx, mpc.Wait())
+
+	rejected, unexplained := -1, []string{}
+	for _, line := range strings.Split(stderr.String(), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if i := rejectedSong(line, songs); i >= 0 && rejected < 0 {
+			rejected = i
+		} else {
+			unexplained = append(unexplained, line)
+		}
+	}
+	if len(unexplained) == 0 && rejected >= 0 {
+		// The rejected song is why mpc failed, and the summary lists it
+		return rejected, nil
+	}
+	if err != nil && len(unexplained) > 0 {
+		err = fmt.Errorf("%v: %s", err, strings.Join(unexplained, "\n"))
+	}
+	return rejected, err
+}
+
+// Finds the song an mpc error like "error adding PATH: reason" is about, -1 if
+// it isn't about any of them
+func rejectedSong(line string, songs []string) int {
+	for i, s := range songs {
+		if strings.HasPrefix(line, "error adding "+s+": ") {
+			return i
+		}
 	}
-	return mpc.Wait()
+	return -1
 }
 
-func readTracks() []*Track {
-	dbFile := findDbFile()
+// Inserts songs after the current song in the order given, returning the
+// position of the first and how many were inserted. mpc insert can put several
+// songs in reverse, so they're added and then moved into place.
+func insertSongs(songs []string) (int, int, error) {
+	current, err := currentPosition()
+	if err != nil {
+		return 0, 0, err
+	}
+	if current > 0 {
+		return insertSongsAfter(songs, current)
+	}
 
-	f, err := os.Open(dbFile)
+	// With no current song inserting behaves like adding
+	length, err := queueLength()
+	if err != nil {
+		return 0, 0, err
+	}
+	added, err := addSongs(songs)
+	return length + 1, added, err
+}
+
+func addSongs(songs []string) (int, error) {
+	return queueSongs("add", songs)
+}
+
+// Reads "DB Updated" from mpc stats, which mpc prints in ctime format
+func mpdLastUpdate() (time.Time, error) {
+	ctx, cancel := mpcContext()
+	defer cancel()
+	out, err := mpcCommand(ctx, "stats").Output()
+	if err != nil {
+		return time.Time{}, mpcError(ctx, err)
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		key, value := keyval(line)
+		if key == "DB Updated" {
+			return time.ParseInLocation(time.ANSIC, strings.TrimSpace(value), time.Local)
+		}
+	}
+	return time.Time{}, errors.New("mpc stats did not report when the database was last updated")
+}
+
+// Returns a description of why the database is stale, or "" if it is fresh
+func dbStaleness(dbFile string) string {
+	st, err := os.Stat(dbFile)
 	fail(err)
-	gz, err := gzip.NewReader(f)
+	mtime := st.ModTime()
+
+	updated, err := mpdLastUpdate()
 	fail(err)
+	// MPD may finish writing the file slightly before or after it records the update
+	if mtime.Before(updated.Add(-time.Minute)) {
+		return fmt.Sprintf("database '%s' was written %s but MPD was last updated %s",
+			dbFile, mtime.Format(time.Stamp), updated.Format(time.Stamp))
+	}
+	if *staleAfter > 0 && time.Since(mtime) > *staleAfter {
+		return fmt.Sprintf("database '%s' has not been updated in over %s", dbFile, *staleAfter)
+	}
+	return ""
+}
 
-	scan := bufio.NewScanner(gz)
-	tracks := groupByArtist(parse(scan))
+func ensureFresh(dbFile string) {
+	reason := dbStaleness(dbFile)
+	if reason == "" {
+		return
+	}
+	failOn(!confirm("The "+reason+". Run 'mpc update' now?"), "Aborting: "+reason)
 
-	fail(gz.Close())
-	fail(f.Close())
-	return tracks
+	info("Updating the MPD database")
+	// Updates can legitimately take a long time
+	fail(mpcCommand(context.Background(), "update", "--wait").Run())
+}
+
+func readDb(dbFile string) ([]*Track, error) {
+	f, err := os.Open(dbFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readDbFrom(f)
+}
+
+// Parses a database, decompressing it first if it's gzipped
+func readDbFrom(in io.Reader) ([]*Track, error) {
+	// Peeking leaves the magic bytes in the buffer for whichever reader follows
+	r := bufio.NewReader(in)
+	magic, _ := r.Peek(2)
+	isGzip := len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b
+	if *noGzip || (!*forceGzip && !isGzip) {
+		return parse(dbScanner(r), false)
+	}
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	return parse(dbScanner(gz), false)
+}
+
+// Splits the database into lines, or NUL terminated records with -nul
+func dbScanner(r io.Reader) *bufio.Scanner {
+	scan := bufio.NewScanner(r)
+	// Tag values can be long, like readResponse allows for
+	scan.Buffer(make([]byte, 64*1024), 1024*1024)
+	if *nulRecords {
+		scan.Split(splitOn("\x00"))
+	}
+	return scan
+}
+
+// A bufio.SplitFunc for records ending in sep
+func splitOn(sep string) bufio.SplitFunc {
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		if i := bytes.Index(data, []byte(sep)); i >= 0 {
+			return i + len(sep), data[:i], nil
+		}
+		if atEOF && len(data) > 0 {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	}
+}
+
+// MPD rewrites the database in place during an update, so a reader can see a
+// partially written file.
+func truncatedDb(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, gzip.ErrChecksum)
+}
+
+const (
+	dbRetries    = 5
+	dbRetryDelay = 2 * time.Second
+)
+
+func readDbFile(dbFile string) []*Track {
+	for attempt := 1; ; attempt++ {
+		tracks, err := readDbCached(dbFile)
+		if err == nil {
+			return tracks
+		}
+		if !truncatedDb(err) {
+			fail(err)
+		}
+		failOn(!*waitForUpdate || attempt > dbRetries, fmt.Sprintf(
+			"Database '%s' appears to be incomplete (%v). "+
+				"MPD may be in the middle of an update, wait for it to finish and try again.",
+			dbFile, err))
+		info("Database appears to be incomplete, retrying in %s", dbRetryDelay)
+		time.Sleep(dbRetryDelay)
+	}
+}
+
+func readTracks(conf *mpdConfig) []*Track {
+	if *fromStdin {
+		tracks, err := readDbFrom(os.Stdin)
+		fail(err)
+		return groupTracks(tracks)
+	}
+	if *protocol {
+		tracks, err := readProtocolTracks()
+		fail(err)
+		return groupTracks(tracks)
+	}
+	if len(dbSources) > 0 {
+		return groupTracks(readSources())
+	}
+	return groupTracks(readDbFile(conf.DbFile))
+}
+
+func queueLength() (int, error) {
+	ctx, cancel := mpcContext()
+	defer cancel()
+	out, err := mpcCommand(ctx, "playlist").Output()
+	if err != nil {
+		return 0, mpcError(ctx, err)
+	}
+	return strings.Count(string(out), "\n"), nil
+}
+
+// Returns the 1-based queue position of the current song, or 0 if there is none
+func currentPosition() (int, error) {
+	ctx, cancel := mpcContext()
+	defer cancel()
+	out, err := mpcCommand(ctx, "current", "-f", "%position%").Output()
+	if err != nil {
+		return 0, mpcError(ctx, err)
+	}
+	if current, err := strconv.Atoi(strings.TrimSpace(string(out))); err == nil {
+		return current, nil
+	}
+	return 0, nil
+}
+
+// Adds songs to the end of the queue and moves them to follow pos, which is
+// clamped to the queue. Returns the position of the first song and the number
+// inserted.
+func insertSongsAfter(songs []string, pos int) (int, int, error) {
+	length, err := queueLength()
+	if err != nil {
+		return 0, 0, err
+	}
+	if pos > length {
+		pos = length
+	}
+
+	added, err := addSongs(songs)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// Moving each song forward leaves the rest of the appended block in place
+	for i := 0; i < added; i++ {
+		if err = moveSong(length+1+i, pos+1+i); err != nil {
+			return pos + 1, i, err
+		}
+	}
+	return pos + 1, added, nil
+}
+
+// Each move gets all of -mpc-timeout, a big selection can take longer than
+// that altogether
+func moveSong(from, to int) error {
+	ctx, cancel := mpcContext()
+	defer cancel()
+	return mpcError(ctx, mpcCommand(ctx, "move", strconv.Itoa(from), strconv.Itoa(to)).Run())
+}
+
+func playNth(index, start, inserted int) error {
+	if index >= inserted {
+		index = inserted - 1
+	}
+	ctx, cancel := mpcContext()
+	defer cancel()
+	return mpcError(ctx, mpcCommand(ctx, "play", strconv.Itoa(start+index)).Run())
+}
+
+// Replaces each song with its whole album in disc and track order, once per
+// album. Songs without an album are left alone.
+func expandAlbums(tracks []*Track, songs []string) []string {
+	byPath := make(map[string]*Track, len(tracks))
+	albums := map[string][]*Track{}
+	key := func(t *Track) string { return artistKey(t) + delimiter + t.Album }
+	for _, t := range tracks {
+		byPath[t.Path] = t
+		if t.Album != "" {
+			albums[key(t)] = append(albums[key(t)], t)
+		}
+	}
+
+	expanded := []string{}
+	seen := map[string]bool{}
+	for _, s := range songs {
+		t := byPath[s]
+		if t == nil || t.Album == "" {
+			expanded = append(expanded, s)
+			continue
+		}
+		if seen[key(t)] {
+			continue
+		}
+		seen[key(t)] = true
+		album := append([]*Track{}, albums[key(t)]...)
+		sort.SliceStable(album, func(i, j int) bool { return albumOrder(album[i], album[j]) })
+		for _, a := range album {
+			expanded = append(expanded, a.Path)
+		}
+	}
+	return expanded
+}
+
+// Keeps the first max songs by each artist
+func limitPerArtist(tracks []*Track, songs []string, max int) []string {
+	byPath := make(map[string]*Track, len(tracks))
+	for _, t := range tracks {
+		byPath[t.Path] = t
+	}
+	counts := map[string]int{}
+	kept := []string{}
+	for _, s := range songs {
+		artist := ""
+		if t := byPath[s]; t != nil {
+			// Paths added in -edit count as one unknown artist
+			artist = artistKey(t)
+		}
+		if counts[artist] >= max {
+			debug("Dropping %s", s)
+			continue
+		}
+		counts[artist]++
+		kept = append(kept, s)
+	}
+	if dropped := len(songs) - len(kept); dropped > 0 {
+		info("Dropped %s over the limit of %d per artist", plural(dropped, "track"), max)
+	}
+	return kept
+}
+
+// Keeps the longest start of songs that plays within budget
+func fitBudget(tracks []*Track, songs []string, budget time.Duration) []string {
+	durations := make(map[string]time.Duration, len(tracks))
+	for _, t := range tracks {
+		durations[t.Path] = t.Duration
+	}
+	total := time.Duration(0)
+	for i, s := range songs {
+		total += durations[s]
+		if total > budget {
+			info("Dropped %s over the %s budget", plural(len(songs)-i, "track"), budget)
+			for _, d := range songs[i:] {
+				debug("Dropping %s", d)
+			}
+			return songs[:i]
+		}
+	}
+	return songs
+}
+
+// What to do with the selection: insert, append, replace, or print
+var action = "insert"
+
+// Asks on the terminal what to do with the selection, false to do nothing
+func askAction() bool {
+	for {
+		answer, err := prompt("(i)nsert, (a)ppend, (r)eplace, (p)rint, or (q)uit? ")
+		if err != nil {
+			return false
+		}
+		switch strings.ToLower(answer) {
+		case "i", "insert":
+			action = "insert"
+		case "a", "append":
+			action = "append"
+		case "r", "replace":
+			action = "replace"
+		case "p", "print":
+			action = "print"
+		case "", "q", "quit":
+			return false
+		default:
+			continue
+		}
+		return true
+	}
+}
+
+// Prints songs one per line, under music_directory with -absolute and quoted
+// for a POSIX shell with -shell-quote
+func printSongs(w io.Writer, songs []string) error {
+	out := bufio.NewWriter(w)
+	for _, s := range songs {
+		if *absolutePaths {
+			s = filepath.Join(musicDir, s)
+		}
+		if *shellQuote {
+			s = quoteShell(s)
+		}
+		out.WriteString(s + "\n")
+	}
+	return out.Flush()
+}
+
+// Nothing is special inside single quotes, so only they need escaping
+func quoteShell(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// Prints what queueSelection would do with a group for -dry-run, without
+// running mpc or talking to MPD
+func describeSelection(group songGroup) {
+	would := func(format string, a ...interface{}) {
+		fmt.Fprintf(os.Stderr, "Would "+format+"\n", a...)
+	}
+	env := strings.Join(group.env, " ")
+	if env != "" {
+		would("run mpc with %s", env)
+	}
+
+	if action == "replace" {
+		would("run: mpc clear")
+	} else {
+		would("remove queued copies of %s", plural(len(group.songs), "track"))
+	}
+	switch {
+	case action == "replace" || action == "append":
+		would("run: mpc add")
+	case *atBookmark:
+		would("run: mpc add, then mpc move for each track to follow the bookmark")
+	default:
+		would("run: mpc add, then mpc move for each track to follow the current song")
+	}
+	for _, s := range group.songs {
+		fmt.Fprintln(os.Stderr, "  "+s)
+	}
+	if *playIndex >= 0 {
+		would("run: mpc play, starting at selected track %d", *playIndex)
+	}
+}
+
+// Prints the mode changes applyPlaybackModes would make, for -dry-run
+func describePlaybackModes() {
+	for _, m := range playbackModes() {
+		if m.value != "" {
+			fmt.Fprintf(os.Stderr, "Would run: mpc %s %s\n", m.command, m.value)
+		}
+	}
+}
+
+func clearQueue() error {
+	ctx, cancel := mpcContext()
+	defer cancel()
+	return mpcError(ctx, mpcCommand(ctx, "clear").Run())
+}
+
+// Queues the songs according to action and the flags, returning the number of
+// entries removed and the number queued. Replacing clears the queue first,
+// otherwise the songs are removed from the queue before being inserted or
+// appended again.
+func queueSelection(songs []string) (int, int) {
+	var removed []int
+	var err error
+	if action == "replace" {
+		fail(clearQueue())
+	} else {
+		removed, err = removeSongs(songs)
+		fail(err)
+	}
+
+	empty := false
+	if *appendIfEmpty {
+		length, err := queueLength()
+		fail(err)
+		empty = length == 0
+	}
+
+	var inserted, start int
+	play := *playIndex >= 0
+	switch {
+	case action == "replace":
+		inserted, err = addSongs(songs)
+		fail(err)
+		start = 1
+	case action == "append":
+		inserted, err = addSongs(songs)
+		fail(err)
+		if play && inserted > 0 {
+			length, err := queueLength()
+			fail(err)
+			start = length - inserted + 1
+		}
+	case *atBookmark:
+		bookmark, err := readBookmark()
+		fail(err)
+		// Entries removed from above the bookmark moved everything after them up
+		shift := 0
+		for _, pos := range removed {
+			if pos <= bookmark {
+				shift++
+			}
+		}
+		bookmark -= shift
+		start, inserted, err = insertSongsAfter(songs, bookmark)
+		fail(err)
+		// Keep later selections after this one rather than in front of it
+		fail(writeBookmark(start + inserted - 1))
+	case empty:
+		// Nothing to insert after, so start a fresh session
+		inserted, err = addSongs(songs)
+		fail(err)
+		start, play = 1, true
+	default:
+		start, inserted, err = insertSongs(songs)
+		fail(err)
+	}
+	if play && inserted > 0 {
+		index := *playIndex
+		if index < 0 {
+			index = 0
+		}
+		fail(playNth(index, start, inserted))
+	}
+	return len(removed), inserted
+}
+
+// Best effort, there may be no notification daemon at all
+func sendNotification(summary string) {
+	if path, err := exec.LookPath("notify-send"); err == nil {
+		exec.Command(path, "mpd-fzf", summary).Run()
+	}
+}
+
+// An mpc mode command for -set-random and co. and the values it accepts
+type playbackMode struct {
+	command, value string
+	allowed        []string
+}
+
+func playbackModes() []playbackMode {
+	onOff := []string{"on", "off"}
+	return []playbackMode{
+		{"random", *setRandom, onOff},
+		{"consume", *setConsume, onOff},
+		{"single", *setSingle, []string{"on", "off", "once"}},
+	}
+}
+
+func validatePlaybackModes() error {
+	for _, m := range playbackModes() {
+		if m.value == "" {
+			continue
+		}
+		ok := false
+		for _, a := range m.allowed {
+			ok = ok || m.value == a
+		}
+		if !ok {
+			return fmt.Errorf("-set-%s must be one of %s", m.command, strings.Join(m.allowed, ", "))
+		}
+	}
+	return nil
+}
+
+// Only touches the modes that were asked for
+func applyPlaybackModes() error {
+	ctx, cancel := mpcContext()
+	defer cancel()
+	for _, m := range playbackModes() {
+		if m.value == "" {
+			continue
+		}
+		if err := mpcCommand(ctx, m.command, m.value).Run(); err != nil {
+			return mpcError(ctx, err)
+		}
+	}
+	return nil
+}
+
+// Runs the -after hook. The queue has already changed, so a failing hook is
+// only reported.
+func runAfterHook(action string, songs []string, count, removed int) error {
+	cmd := exec.Command("sh", "-c", *afterCmd)
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	cmd.Env = append(os.Environ(),
+		"MPD_FZF_ACTION="+action,
+		"MPD_FZF_COUNT="+strconv.Itoa(count),
+		"MPD_FZF_REMOVED="+strconv.Itoa(removed),
+		"MPD_FZF_SONGS="+strings.Join(songs, "\n"))
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("-after command failed: %v", err)
+	}
+	return nil
 }
 
 func main() {
-	songs := fzfSongs(readTracks())
+	flag.Parse()
+	if *previewFor >= 0 {
+		fail(printPreview(os.Stdout, *previewFor))
+		return
+	}
+	// Anything modified while the picker is open counts as new next time
+	started := time.Now()
+	// Anything left over is for fzf, but only if it was set apart with --
+	if rest := flag.Args(); len(rest) > 0 && os.Args[len(os.Args)-len(rest)-1] != "--" {
+		fail(fmt.Errorf("Unexpected argument '%s', arguments for fzf go after --", rest[0]))
+	}
+	failOn(*quiet && *verbose, "-quiet and -v are mutually exclusive")
+	failOn(*sinceLastFirst != "all" && *sinceLastFirst != "none", "-since-last-first must be all or none")
+	failOn(*forceGzip && *noGzip, "-gzip and -no-gzip are mutually exclusive")
+	failOn(*withArt && *noArt, "-with-art and -no-art are mutually exclusive")
+	failOn(*byAlbum && *groupByDir, "-album and -group-by-dir are mutually exclusive")
+	failOn(*noGroup && (*byAlbum || *groupByDir), "-no-group cannot be used with -album or -group-by-dir")
+	failOn(*appendSongs && *atBookmark, "-add and -at-bookmark are mutually exclusive")
+	failOn(*replaceQueue && (*appendSongs || *atBookmark),
+		"-replace cannot be used with -add or -at-bookmark")
+	failOn(*printOnly && (*appendSongs || *replaceQueue), "-print cannot be used with -add or -replace")
+	fail(validateDedupe())
+	fail(validatePlaybackModes())
+	fail(setSearchLayout())
+	failOn(*lineFormat != "" && len(searchLayout) > 0, "-format cannot be used with -search-fields")
+	if *lineFormat != "" {
+		var err error
+		lineTemplate, err = parseTemplate(*lineFormat)
+		fail(err)
+	}
+	var err error
+	sortFields, err = parseFields(*sortBy)
+	fail(err)
+	fail(validateMetadataSource())
+	failOn(*dbPath != "" && (*protocol || len(dbSources) > 0 || *dbDir != ""),
+		"-db cannot be used with -protocol, -db-file, or -db-dir")
+	failOn(*fromStdin && (*protocol || *dbPath != "" || len(dbSources) > 0 || *dbDir != ""),
+		"-stdin cannot be used with -protocol, -db, -db-file, or -db-dir")
+	failOn(strings.ContainsAny(*colorScheme, " \t\n"), "-color-scheme cannot contain whitespace")
+	if *dbDir != "" {
+		fail(addDirSources(*dbDir))
+	}
+	if *appendSongs {
+		action = "append"
+	} else if *replaceQueue {
+		action = "replace"
+	}
+	if *printOnly {
+		action = "print"
+	}
+	if *playFirst && *playIndex < 0 {
+		*playIndex = 0
+	}
+
+	// Exported rather than passed to mpc, so every child process and the
+	// protocol client agree on the server
+	if *mpdHostFlag != "" {
+		fail(os.Setenv("MPD_HOST", *mpdHostFlag))
+	}
+	if *mpdPortFlag != "" {
+		fail(os.Setenv("MPD_PORT", *mpdPortFlag))
+	}
+	conf := readConfig()
+	if *dbPath != "" {
+		conf.DbFile = *dbPath
+	}
+	setMpcHost(conf)
+	musicDir = conf.MusicDir
+	failOn(*absolutePaths && musicDir == "", "-absolute needs music_directory from the MPD config")
+	if *showSize && musicDir == "" {
+		info("No music_directory in the MPD config, sizes will not be shown")
+	}
+	if *setBookmark {
+		pos, err := currentPosition()
+		fail(err)
+		failOn(pos == 0, "There is no current song to bookmark")
+		fail(writeBookmark(pos))
+		info("Bookmarked queue position %d", pos)
+		return
+	}
+	if *fresh && *dryRun {
+		info("Not checking the database is up to date with -dry-run")
+	} else if *fresh && !*protocol && !*fromStdin {
+		if len(dbSources) == 0 {
+			ensureFresh(conf.DbFile)
+		}
+		for _, src := range dbSources {
+			mpcEnv = src.env()
+			ensureFresh(src.File)
+		}
+	}
+
+	// Fail before the slow part if the rest can't be done
+	if !*validateDb && !*stats && !*statsJSON && !*tree && !*dumpLines {
+		findFzf()
+		if action != "print" && !*dryRun {
+			findMpc()
+		}
+	}
+
+	if *validateDb {
+		collectAnomalies = true
+		// Problems are only found while parsing
+		*useCache = false
+		problems := validate(os.Stdout, readTracks(conf))
+		if *strict && problems > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	tracks := readTracks(conf)
+	inDatabase := len(tracks)
+	if *metadataSource == "beets" {
+		addBeetsMetadata(tracks)
+	}
+	if *tracksFile != "" {
+		tracks = tracksFromFile(tracks, *tracksFile)
+	}
+	tracks = filterTracks(tracks, matchesFilters)
+	if len(untagged.fields) > 0 {
+		tracks = filterTracks(tracks, func(t *Track) bool { return missingField(t, untagged.fields) })
+	}
+	if *dedupe != "" {
+		tracks = dedupeTracks(tracks, *dedupe)
+	}
+	if *sinceLast {
+		last, err := readLastRun()
+		fail(err)
+		if !last.IsZero() {
+			tracks = filterTracks(tracks, func(t *Track) bool { return t.Modified.After(last) })
+		} else if *sinceLastFirst == "none" {
+			tracks = nil
+		}
+	}
+	if *recent > 0 {
+		tracks = recentTracks(tracks, *recent)
+	}
+	if len(sortFields) > 0 {
+		sortTracks(tracks, sortFields)
+	}
+
+	if *stats || *statsJSON {
+		fail(printStats(os.Stdout, tracks, *statsJSON))
+		return
+	}
+	if *tree {
+		fail(printTree(os.Stdout, tracks))
+		return
+	}
+
+	if *dumpLines {
+		out := bufio.NewWriter(os.Stdout)
+		writeLines(out, tracks)
+		fail(out.Flush())
+		return
+	}
+
+	// fzf would open with nothing to pick and exit without a word
+	if len(tracks) == 0 {
+		if inDatabase == 0 {
+			info("No tracks found in the database; run 'mpc update' and try again")
+		} else {
+			info("Nothing left to show out of %s in the database", plural(inDatabase, "track"))
+		}
+		return
+	}
+
+	var songs []string
+	if *browse && *filterQuery == "" {
+		songs = browseSongs(tracks)
+	} else {
+		songs = fzfSongs(tracks)
+	}
+	songs = knownSongs(tracks, songs)
+	if *preserveOrder {
+		songs = displayOrder(tracks, songs)
+	}
+	if *edit && len(songs) > 0 {
+		var err error
+		songs, err = editSongs(songs)
+		fail(err)
+	}
+	if *expandAlbum {
+		songs = expandAlbums(tracks, songs)
+	}
+	if *insertMaxPerArtist > 0 {
+		songs = limitPerArtist(tracks, songs, *insertMaxPerArtist)
+	}
+	if *budget > 0 {
+		songs = fitBudget(tracks, songs, *budget)
+	}
 	if len(songs) == 0 {
 		return
 	}
+	if *ask && !askAction() {
+		return
+	}
+	if action == "print" {
+		fail(printSongs(os.Stdout, songs))
+		fail(writeLastRun(started))
+		return
+	}
+
+	removed, inserted := 0, 0
+	if *dryRun {
+		for _, group := range routeSongs(tracks, songs) {
+			describeSelection(group)
+		}
+		describePlaybackModes()
+		return
+	}
+	groups := routeSongs(tracks, songs)
+	for _, group := range groups {
+		mpcEnv = group.env
+		r, i := queueSelection(group.songs)
+		removed += r
+		inserted += i
+	}
+	// Once, on the server the selection starts on
+	mpcEnv = groups[0].env
+	fail(applyPlaybackModes())
 
-	fail(removeSongs(songs))
-	fail(insertSongs(songs))
+	summary := "Inserted " + plural(inserted, "track")
+	switch action {
+	case "append":
+		summary = "Appended " + plural(inserted, "track")
+	case "replace":
+		summary = "Replaced the queue with " + plural(inserted, "track")
+	}
+	if removed > 0 {
+		summary += ", removed " + plural(removed, "duplicate")
+	}
+	if len(failedSongs) > 0 {
+		summary += ", " + plural(len(failedSongs), "track") + " could not be added: " +
+			strings.Join(failedSongs, ", ")
+	}
+	info("%s", summary)
+	if *notify {
+		sendNotification(summary)
+	}
+
+	fail(writeLastRun(started))
+	if *afterCmd != "" {
+		if err := runAfterHook(action, songs, inserted, removed); err != nil {
+			info("%v", err)
+		}
+	}
 }
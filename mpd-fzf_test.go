@@ -0,0 +1,1184 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	runewidth "github.com/mattn/go-runewidth"
+)
+
+func writeFile(t *testing.T, dir, name, contents string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func readTestConfig(t *testing.T, path string) *mpdConfig {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := &mpdConfig{Path: path}
+	if err = scanConfig(conf, f, "/home/user", 0); err != nil {
+		t.Fatal(err)
+	}
+	return conf
+}
+
+func TestConfigBindAddresses(t *testing.T) {
+	tests := []struct {
+		name, conf string
+		addresses  []string
+		host, port string
+	}{
+		{
+			name: "socket and tcp",
+			conf: `bind_to_address "0.0.0.0"
+bind_to_address "~/.mpd/socket"
+port "6601"
+`,
+			addresses: []string{"0.0.0.0", "/home/user/.mpd/socket"},
+			host:      "/home/user/.mpd/socket",
+		},
+		{
+			name:      "tcp only",
+			conf:      "bind_to_address \"any\"\nport \"6601\"\n",
+			addresses: []string{"any"},
+			host:      "localhost",
+			port:      "6601",
+		},
+		{
+			name:      "host and port",
+			conf:      "bind_to_address \"music.lan:6602\"\n",
+			addresses: []string{"music.lan:6602"},
+			host:      "music.lan",
+			port:      "6602",
+		},
+		{
+			name: "nothing",
+			conf: "port \"6601\"\n",
+			port: "6601",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := readTestConfig(t, writeFile(t, t.TempDir(), "mpd.conf", tt.conf))
+			if !reflect.DeepEqual(conf.BindAddresses, tt.addresses) {
+				t.Errorf("addresses %q, want %q", conf.BindAddresses, tt.addresses)
+			}
+			if host, port := conf.mpdHost(); host != tt.host || port != tt.port {
+				t.Errorf("got %q %q, want %q %q", host, port, tt.host, tt.port)
+			}
+		})
+	}
+}
+
+// Points mpc invocations at a shell script for the rest of the test
+func fakeMpc(t *testing.T, script string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "mpc")
+	if err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"+script), 0700); err != nil {
+		t.Fatal(err)
+	}
+	old := mpcPath
+	mpcPath = path
+	t.Cleanup(func() {
+		mpcPath = old
+		failedSongs = nil
+	})
+}
+
+func TestQueueSongsFailures(t *testing.T) {
+	songs := []string{"kept/a.flac", "gone/b.flac", "kept/c.flac", "gone/d.flac", "kept/e.flac"}
+	// Like MPD, stops at the first path it doesn't know, and like mpc, only
+	// reports that one
+	stopAtGone := `while read -r song; do
+	case "$song" in
+	gone*) echo "error adding $song: No such directory" >&2; exit 1 ;;
+	*) echo "$song" >>"$ADDED" ;;
+	esac
+done
+`
+	tests := []struct {
+		name    string
+		script  string
+		queued  int
+		added   []string
+		failed  []string
+		wantErr string
+	}{
+		{
+			name:   "all queued",
+			script: "cat >>\"$ADDED\"\n",
+			queued: 5,
+			added:  songs,
+		},
+		{
+			name:   "unknown paths",
+			script: stopAtGone,
+			queued: 3,
+			added:  []string{"kept/a.flac", "kept/c.flac", "kept/e.flac"},
+			failed: []string{"gone/b.flac", "gone/d.flac"},
+		},
+		{
+			name: "unknown path and a real error",
+			script: strings.Replace(stopAtGone, "exit 1",
+				`echo "MPD error: Connection refused" >&2; exit 1`, 1),
+			queued:  1,
+			added:   []string{"kept/a.flac"},
+			failed:  []string{"gone/b.flac"},
+			wantErr: "Connection refused",
+		},
+		{
+			name:    "a path that only contains a selected one",
+			script:  "cat >/dev/null\necho 'error adding gone/b.flac.bak: No such directory' >&2\nexit 1\n",
+			queued:  5,
+			wantErr: "gone/b.flac.bak",
+		},
+		{
+			name:    "no output",
+			script:  "cat >/dev/null\nexit 1\n",
+			queued:  5,
+			wantErr: "exit status 1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			added := filepath.Join(t.TempDir(), "added")
+			setEnv(t, "ADDED", added)
+			fakeMpc(t, tt.script)
+			queued, err := queueSongs("add", songs)
+			if queued != tt.queued {
+				t.Errorf("queued %d, want %d", queued, tt.queued)
+			}
+			if strings.Join(failedSongs, ",") != strings.Join(tt.failed, ",") {
+				t.Errorf("failed %q, want %q", failedSongs, tt.failed)
+			}
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("error %v, want one containing %q", err, tt.wantErr)
+			}
+			contents, _ := ioutil.ReadFile(added)
+			if got := strings.Fields(string(contents)); strings.Join(got, ",") != strings.Join(tt.added, ",") {
+				t.Errorf("mpc added %q, want %q", got, tt.added)
+			}
+		})
+	}
+}
+
+const testDb = `format: 2
+directory: Artist
+mtime: 1
+begin: Artist
+song_begin: one.flac
+Artist: Artist
+Title: One
+Time: 61
+song_end
+song_begin: two.flac
+Artist: Artist
+Title: Two
+song_end
+end: Artist
+`
+
+// Compresses 50 copies of s, enough for a stream worth cutting short
+func gzipped(t *testing.T, s string) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	gz := gzip.NewWriter(&b)
+	if _, err := gz.Write([]byte(strings.Repeat(s, 50))); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestReadTruncatedGzip(t *testing.T) {
+	whole := gzipped(t, testDb)
+	if _, err := readDbFrom(bytes.NewReader(whole)); err != nil {
+		t.Fatalf("complete database: %v", err)
+	}
+	for _, cut := range []int{len(whole) / 2, len(whole) - 4} {
+		_, err := readDbFrom(bytes.NewReader(whole[:cut]))
+		if err == nil || !truncatedDb(err) {
+			t.Errorf("cut at %d of %d: got %v, want a truncation error", cut, len(whole), err)
+		}
+	}
+}
+
+func TestFormatDurationString(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"", ""},
+		{"abc", ""},
+		{"0", "(00:00)"},
+		{"7", "(00:07)"},
+		{"60", "(01:00)"},
+		{"245.7", "(04:05)"},
+		{"3600", "(1:00:00)"},
+		{"7384", "(2:03:04)"},
+		{"59", "(00:59)"},
+		{"61", "(01:01)"},
+		{"3661", "(1:01:01)"},
+		// Past a day, where formatting as a time of day used to wrap
+		{"90000", "(25:00:00)"},
+	}
+	for _, tt := range tests {
+		if got := formatDurationString(tt.in); got != tt.want {
+			t.Errorf("formatDurationString(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func setString(t *testing.T, flag *string, value string) {
+	old := *flag
+	*flag = value
+	t.Cleanup(func() { *flag = old })
+}
+
+func parseDb(t *testing.T, db string) []*Track {
+	t.Helper()
+	tracks, err := parse(bufio.NewScanner(strings.NewReader(db)), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tracks
+}
+
+func paths(tracks []*Track) []string {
+	p := []string{}
+	for _, t := range tracks {
+		p = append(p, t.Path)
+	}
+	return p
+}
+
+const genreDb = `directory: a
+begin: a
+song_begin: rock.flac
+Genre: Rock
+Genre: Alternative
+song_end
+song_begin: metal.flac
+Genre: Rock
+Genre: Metal
+song_end
+song_begin: jazz.flac
+Genre: Jazz
+song_end
+end: a
+`
+
+func TestGenreFilter(t *testing.T) {
+	tracks := parseDb(t, genreDb)
+	if got := tracks[0].Genre(); got != "Rock; Alternative" {
+		t.Errorf("Genre() = %q, want both genres", got)
+	}
+
+	tests := []struct {
+		genre string
+		want  []string
+	}{
+		{"rock", []string{"a/rock.flac", "a/metal.flac"}},
+		{"alternative", []string{"a/rock.flac"}},
+		{"metal", []string{"a/metal.flac"}},
+		{"polka", []string{}},
+	}
+	for _, tt := range tests {
+		setString(t, genre, tt.genre)
+		if got := paths(filterTracks(tracks, matchesFilters)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("-genre %s: got %q, want %q", tt.genre, got, tt.want)
+		}
+	}
+}
+
+func setBool(t *testing.T, flag *bool, value bool) {
+	old := *flag
+	*flag = value
+	t.Cleanup(func() { *flag = old })
+}
+
+func TestForcedGzipModes(t *testing.T) {
+	plain, compressed := []byte(testDb), gzipped(t, testDb)
+	tests := []struct {
+		name         string
+		force, never bool
+		in           []byte
+		tracks       int
+		wantErr      bool
+	}{
+		{name: "detect plain", in: plain, tracks: 2},
+		{name: "detect gzip", in: compressed, tracks: 100},
+		{name: "-gzip on gzip", force: true, in: compressed, tracks: 100},
+		{name: "-gzip on plain", force: true, in: plain, wantErr: true},
+		{name: "-no-gzip on plain", never: true, in: plain, tracks: 2},
+		{name: "-no-gzip on gzip", never: true, in: compressed, tracks: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setBool(t, forceGzip, tt.force)
+			setBool(t, noGzip, tt.never)
+			tracks, err := readDbFrom(bytes.NewReader(tt.in))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want error %t", err, tt.wantErr)
+			}
+			if len(tracks) != tt.tracks {
+				t.Errorf("read %d tracks, want %d", len(tracks), tt.tracks)
+			}
+		})
+	}
+}
+
+// Points runFzf at a shell script for the rest of the test
+func fakeFzf(t *testing.T, script string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "fzf")
+	if err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"+script), 0700); err != nil {
+		t.Fatal(err)
+	}
+	old := fzfPath
+	fzfPath = path
+	t.Cleanup(func() { fzfPath = old })
+}
+
+func TestAbortedFzf(t *testing.T) {
+	// Aborting exits the whole process, so that half runs in a child
+	if os.Getenv("MPD_FZF_TEST_ABORT") != "" {
+		fakeFzf(t, "cat >/dev/null\necho 'marked line'\nexit 130\n")
+		songs := parseFzfOutput(runFzf(nil, func(w io.Writer) {
+			writeLines(w, parseDb(t, testDb))
+		}))
+		fmt.Printf("acted on %q\n", songs)
+		return
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestAbortedFzf$")
+	cmd.Env = append(os.Environ(), "MPD_FZF_TEST_ABORT=1")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("aborting should exit cleanly: %v\n%s", err, out)
+	}
+	if strings.Contains(string(out), "acted on") {
+		t.Errorf("an aborted selection was used: %s", out)
+	}
+}
+
+func TestNegativeFilters(t *testing.T) {
+	tracks := parseDb(t, `directory: a
+begin: a
+song_begin: 1.flac
+Artist: Band
+Genre: Rock
+song_end
+song_begin: 2.flac
+Artist: Band
+Genre: Rock
+Genre: Metal
+song_end
+song_begin: 3.flac
+Artist: Other Band
+AlbumArtist: Compilation
+Genre: Rock
+song_end
+song_begin: 4.flac
+Artist: Band
+Genre: Jazz
+song_end
+end: a
+`)
+	tests := []struct {
+		genre, notGenre, artist, notArtist string
+		want                               []string
+	}{
+		{genre: "rock", notGenre: "metal", want: []string{"a/1.flac", "a/3.flac"}},
+		{notGenre: "rock", want: []string{"a/4.flac"}},
+		{genre: "rock", notArtist: "compilation", want: []string{"a/1.flac", "a/2.flac"}},
+		{artist: "band", notGenre: "jazz", notArtist: "other",
+			want: []string{"a/1.flac", "a/2.flac"}},
+		// Excluding always wins
+		{genre: "metal", notGenre: "metal", want: []string{}},
+	}
+	for _, tt := range tests {
+		setString(t, genre, tt.genre)
+		setString(t, notGenre, tt.notGenre)
+		setString(t, artist, tt.artist)
+		setString(t, notArtist, tt.notArtist)
+		if got := paths(filterTracks(tracks, matchesFilters)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%+v: got %q", tt, got)
+		}
+	}
+}
+
+func TestSelectionOrder(t *testing.T) {
+	tracks := []*Track{{Path: "a/1.flac"}, {Path: "a/2.flac"}, {Path: "b/3.flac"}}
+	// Marked bottom to top
+	output := "Three " + delimiter + "b/3.flac\nOne " + delimiter + "a/1.flac\nTwo " +
+		delimiter + "a/2.flac\n"
+
+	songs := parseFzfOutput([]byte(output))
+	if want := []string{"b/3.flac", "a/1.flac", "a/2.flac"}; !reflect.DeepEqual(songs, want) {
+		t.Errorf("fzf's order: got %q, want %q", songs, want)
+	}
+	if got, want := displayOrder(tracks, songs), paths(tracks); !reflect.DeepEqual(got, want) {
+		t.Errorf("-preserve-order: got %q, want %q", got, want)
+	}
+}
+
+func TestMpcTimeout(t *testing.T) {
+	fakeMpc(t, "exec sleep 10\n")
+	old := *mpcTimeout
+	*mpcTimeout = 100 * time.Millisecond
+	defer func() { *mpcTimeout = old }()
+
+	start := time.Now()
+	err := clearQueue()
+	if err == nil || !strings.Contains(err.Error(), "MPD not responding") {
+		t.Errorf("got %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("took %s to give up", elapsed)
+	}
+}
+
+func setEnv(t *testing.T, key, value string) {
+	old, had := os.LookupEnv(key)
+	os.Setenv(key, value)
+	t.Cleanup(func() {
+		if had {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+func TestConfigPathsFromEnv(t *testing.T) {
+	dir := t.TempDir()
+	first := writeFile(t, dir, "first.conf", "db_file \"/first/database\"\n")
+	second := writeFile(t, dir, "second.conf", "db_file \"/second/database\"\n")
+	setEnv(t, "MPD_FZF_CONFIG_PATHS",
+		strings.Join([]string{filepath.Join(dir, "missing.conf"), first, second}, ":"))
+
+	conf := readConfig()
+	if conf.Path != first || conf.DbFile != "/first/database" {
+		t.Errorf("read %s with db_file %s, want %s", conf.Path, conf.DbFile, first)
+	}
+}
+
+func TestMaxResults(t *testing.T) {
+	tracks := []*Track{}
+	for i := 1; i <= 5; i++ {
+		tracks = append(tracks, &Track{Path: fmt.Sprintf("a/%d.flac", i), Title: "Song"})
+	}
+	// Everything matches, best first
+	fakeFzf(t, "cat\n")
+	setString(t, filterQuery, "song")
+
+	tests := []struct {
+		max  int
+		want []string
+	}{
+		{0, paths(tracks)},
+		{2, []string{"a/1.flac", "a/2.flac"}},
+		{10, paths(tracks)},
+	}
+	old := *maxResults
+	defer func() { *maxResults = old }()
+	for _, tt := range tests {
+		*maxResults = tt.max
+		if got := fzfSongs(tracks); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("-max-results %d: got %q, want %q", tt.max, got, tt.want)
+		}
+	}
+}
+
+// Collects anomalies like -validate for the rest of the test, instead of
+// printing them
+func collectTestAnomalies(t *testing.T) {
+	collectAnomalies, anomalies = true, nil
+	t.Cleanup(func() { collectAnomalies, anomalies = false, nil })
+}
+
+func TestEmptySongBegin(t *testing.T) {
+	collectTestAnomalies(t)
+	tracks := parseDb(t, `directory: Album
+begin: Album
+song_begin:
+Title: Not a song
+song_end
+song_begin: real.flac
+Title: Real
+song_end
+end: Album
+`)
+	if got := paths(tracks); !reflect.DeepEqual(got, []string{"Album/real.flac"}) {
+		t.Errorf("got %q, want only the real song", got)
+	}
+	if tracks[0].Title != "Real" {
+		t.Errorf("the skipped record's tags leaked into %+v", tracks[0])
+	}
+	if len(anomalies) != 1 || !strings.Contains(anomalies[0], "line 3") {
+		t.Errorf("anomalies %q, want one for line 3", anomalies)
+	}
+}
+
+func TestSearchFieldsNth(t *testing.T) {
+	track := &Track{Artist: "Artist", Title: "Title", Album: "Album", Time: "(01:01)", Path: "a/b.flac"}
+	tests := []struct {
+		fields string
+		art    bool
+		nth    string
+	}{
+		{"artist,title", false, "1,2"},
+		{"title", false, "2"},
+		{"album, time", false, "3,4"},
+		{"title,artist", true, "3,2"},
+	}
+	for _, tt := range tests {
+		setString(t, searchFields, tt.fields)
+		setBool(t, showArt, tt.art)
+		searchLayout, searchNth = nil, nil
+		if err := setSearchLayout(); err != nil {
+			t.Fatal(err)
+		}
+
+		args := strings.Join(trackFzfArgs(), " ")
+		if !strings.Contains(args, "--nth="+tt.nth) {
+			t.Errorf("-search-fields %s: args %q, want --nth=%s", tt.fields, args, tt.nth)
+		}
+		// The fields --nth picks have to be the ones the line puts there
+		line := strings.Split(trackFormatter()(track), "\t")
+		for i, n := range strings.Split(tt.nth, ",") {
+			var index int
+			fmt.Sscan(n, &index)
+			name := strings.TrimSpace(strings.Split(tt.fields, ",")[i])
+			value, _ := track.Field(name)
+			if !strings.Contains(line[index-1], value) {
+				t.Errorf("-search-fields %s: field %d is %q, want the %s", tt.fields, index, line[index-1], name)
+			}
+		}
+	}
+	searchLayout, searchNth = nil, nil
+}
+
+func TestGroupByDir(t *testing.T) {
+	// Interleaved, as directories from different sources can be after merging
+	tracks := []*Track{
+		{Path: "a/1.flac"}, {Path: "b/1.flac"}, {Path: "a/2.flac"},
+		{Path: "c/d/1.flac"}, {Path: "b/2.flac"}, {Path: "a/3.flac"}, {Path: "c/2.flac"},
+	}
+	setBool(t, groupByDir, true)
+	for seed := int64(1); seed <= 20; seed++ {
+		old := *shuffleSeed
+		*shuffleSeed = seed
+		grouped := groupTracks(append([]*Track{}, tracks...))
+		*shuffleSeed = old
+
+		if len(grouped) != len(tracks) {
+			t.Fatalf("seed %d: got %d tracks, want %d", seed, len(grouped), len(tracks))
+		}
+		// Once a directory ends it never comes back, and its tracks keep their order
+		done, last := map[string]bool{}, map[string]string{}
+		prev := ""
+		for _, track := range grouped {
+			dir := path.Dir(track.Path)
+			if dir != prev {
+				if done[dir] {
+					t.Fatalf("seed %d: %s is split up in %q", seed, dir, paths(grouped))
+				}
+				done[prev] = true
+				prev = dir
+			}
+			if track.Path < last[dir] {
+				t.Errorf("seed %d: %s is out of order in %q", seed, track.Path, paths(grouped))
+			}
+			last[dir] = track.Path
+		}
+	}
+}
+
+func TestExpandUser(t *testing.T) {
+	me, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct{ in, want string }{
+		{"", ""},
+		{"~", "/home/user"},
+		{"~/x", "/home/user/x"},
+		{"/abs", "/abs"},
+		{"x~", "x~"},
+		{"~" + me.Username + "/music", me.HomeDir + "/music"},
+	}
+	for _, tt := range tests {
+		got, err := expandUser(tt.in, "/home/user")
+		if err != nil || got != tt.want {
+			t.Errorf("expandUser(%q) = %q, %v, want %q", tt.in, got, err, tt.want)
+		}
+	}
+	if _, err := expandUser("~no-such-user-here/x", "/home/user"); err == nil {
+		t.Error("expanding an unknown user should fail")
+	}
+}
+
+func TestNulRecords(t *testing.T) {
+	setBool(t, nulRecords, true)
+	db := strings.Join([]string{
+		"format: 2",
+		"directory: odd",
+		"begin: odd",
+		"song_begin: two\nlines.flac",
+		"Title: Two\nLines",
+		"song_end",
+		"song_begin: plain.flac",
+		"song_end",
+		"end: odd",
+	}, "\x00") + "\x00"
+
+	tracks, err := readDbFrom(strings.NewReader(db))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := paths(tracks), []string{"odd/two\nlines.flac", "odd/plain.flac"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	if tracks[0].Title != "Two\nLines" {
+		t.Errorf("title %q, want the newline kept", tracks[0].Title)
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	songs := []string{
+		"plain/song.flac",
+		"with spaces/01 a song.flac",
+		"it's/\"quoted\".flac",
+		"$HOME/`date`/$(rm -rf x);*.flac",
+		"back\\slash\\n.flac",
+	}
+	setBool(t, shellQuote, true)
+	var out bytes.Buffer
+	if err := printSongs(&out, songs); err != nil {
+		t.Fatal(err)
+	}
+
+	// The shell has to hand back exactly the paths that were printed
+	cmd := exec.Command("sh", "-c", `for p in `+strings.Replace(out.String(), "\n", " ", -1)+
+		`; do printf '%s\n' "$p"; done`)
+	got, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := strings.Join(songs, "\n") + "\n"; string(got) != want {
+		t.Errorf("the shell read\n%s\nwant\n%s", got, want)
+	}
+}
+
+// A fake mpc keeping its queue in a file, one song per line, with the current
+// song at position current. Moves take $MOVE_DELAY seconds.
+func fakeMpcQueue(t *testing.T, queue []string, current int) string {
+	t.Helper()
+	dir := t.TempDir()
+	file := writeFile(t, dir, "queue", strings.Join(queue, "\n")+"\n")
+	writeFile(t, dir, "current", fmt.Sprintf("%d\n", current))
+	fakeMpc(t, fmt.Sprintf(`q=%s
+case "$1" in
+playlist) cat "$q" ;;
+current) cat %s ;;
+add) cat >>"$q" ;;
+move) sleep "${MOVE_DELAY:-0}"; awk -v from="$2" -v to="$3" '{ l[NR] = $0 }
+	END {
+		n = 0
+		for (i = 1; i <= NR; i++) if (i != from) r[++n] = l[i]
+		for (i = 1; i <= NR; i++) { if (i == to) print l[from]; if (i <= n) print r[i] }
+	}' "$q" >"$q.new" && mv "$q.new" "$q" ;;
+*) echo "unexpected mpc $*" >&2; exit 1 ;;
+esac
+`, quoteShell(file), quoteShell(filepath.Join(dir, "current"))))
+	return file
+}
+
+func TestInsertKeepsSelectionOrder(t *testing.T) {
+	file := fakeMpcQueue(t, []string{"x.flac", "playing.flac", "z.flac"}, 2)
+	start, inserted, err := insertSongs([]string{"c.flac", "a.flac", "b.flac"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if start != 3 || inserted != 3 {
+		t.Errorf("inserted %d at %d, want 3 at 3", inserted, start)
+	}
+	queue, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "x.flac\nplaying.flac\nc.flac\na.flac\nb.flac\nz.flac\n"
+	if string(queue) != want {
+		t.Errorf("queue is\n%s\nwant\n%s", queue, want)
+	}
+}
+
+func TestSortByFields(t *testing.T) {
+	tracks := parseDb(t, `directory: a
+begin: a
+song_begin: 10.flac
+AlbumArtist: B
+Album: First
+Disc: 1
+Track: 10
+song_end
+song_begin: 2.flac
+AlbumArtist: B
+Album: First
+Disc: 1/2
+Track: 2/12
+song_end
+song_begin: 2-1.flac
+AlbumArtist: B
+Album: First
+Disc: 2/2
+Track: 1
+song_end
+song_begin: other.flac
+AlbumArtist: a
+Album: Second
+Track: 1
+song_end
+song_begin: untagged.flac
+song_end
+end: a
+`)
+	fields, err := parseFields("albumartist, album,disc,TRACK")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sortTracks(tracks, fields)
+	// Missing fields first, case ignored, and 2 before 10
+	want := []string{"a/untagged.flac", "a/other.flac", "a/2.flac", "a/10.flac", "a/2-1.flac"}
+	if got := paths(tracks); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if _, err := parseFields("album,bitrate"); err == nil {
+		t.Error("an unknown field should be an error")
+	}
+}
+
+func TestPathsSurviveFormatting(t *testing.T) {
+	tracks := []*Track{
+		{Artist: "AC/DC", Title: "Back////In Black", Album: "a//b", Path: "AC/DC/Back In Black/01.flac"},
+		{Title: "Odd", Path: "odd////dir//file.flac"},
+		{Filename: "untitled.mp3", Path: "no tags/untitled.mp3"},
+	}
+	var out bytes.Buffer
+	writeLines(&out, tracks)
+	if got, want := parseFzfOutput(out.Bytes()), paths(tracks); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestUnknownSongsSkipped(t *testing.T) {
+	tracks := []*Track{{Path: "a/1.flac"}, {Path: "a/2.flac"}}
+	// A line whose delimiter was mangled comes back as the whole line
+	output := "One " + delimiter + "a/1.flac\nTwo [broken] a/2.flac\nTwo " + delimiter + "a/2.flac\n"
+	songs := knownSongs(tracks, parseFzfOutput([]byte(output)))
+	if want := []string{"a/1.flac", "a/2.flac"}; !reflect.DeepEqual(songs, want) {
+		t.Errorf("got %q, want %q", songs, want)
+	}
+}
+
+func TestNarrowWidths(t *testing.T) {
+	// An 8 column terminal leaves 3 columns for fzf, less than a time takes up,
+	// so widths can go negative
+	for _, s := range []string{"", "Artist - Title", "日本語のタイトル", "ábc"} {
+		for width := -10; width <= 10; width++ {
+			got := truncateAndPad(s, width, "..")
+			want := width
+			if want < 0 {
+				want = 0
+			}
+			if w := runewidth.StringWidth(got); w != want {
+				t.Errorf("truncateAndPad(%q, %d) = %q, %d columns wide", s, width, got, w)
+			}
+		}
+	}
+
+	searchLayout = []string{"artist", "title", "album", "time", "path"}
+	defer func() { searchLayout = nil }()
+	line := fieldLine("", []string{"Artist", "- Title", "{Album}"}, "(1:00:00)", 3, "a/b.flac")
+	if !strings.HasSuffix(line, delimiter+"a/b.flac") {
+		t.Errorf("-search-fields line %q lost its path", line)
+	}
+}
+
+func TestEmptyDatabase(t *testing.T) {
+	for _, db := range [][]byte{nil, []byte("format: 2\n"), gzipped(t, "")} {
+		tracks, err := readDbFrom(bytes.NewReader(db))
+		if err != nil || len(tracks) != 0 {
+			t.Errorf("%q: got %d tracks and %v", db, len(tracks), err)
+		}
+	}
+
+	// fzf shouldn't even be started
+	if os.Getenv("MPD_FZF_TEST_EMPTY") != "" {
+		fakeFzf(t, "echo 'fzf was started' >&2\nexit 2\n")
+		os.Args = []string{"mpd-fzf", "-stdin", "-print", "-fzf", fzfPath}
+		main()
+		return
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestEmptyDatabase$")
+	cmd.Env = append(os.Environ(), "MPD_FZF_TEST_EMPTY=1")
+	cmd.Stdin = strings.NewReader("format: 2\n")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("an empty database should exit cleanly: %v\n%s", err, out)
+	}
+	if !strings.Contains(string(out), "No tracks found in the database") ||
+		strings.Contains(string(out), "fzf was started") {
+		t.Errorf("unexpected output:\n%s", out)
+	}
+}
+
+func TestTruncatedSongs(t *testing.T) {
+	tests := []struct {
+		name      string
+		db        string
+		want      []string
+		titles    []string
+		anomalies int
+	}{
+		{
+			name: "ends mid-song",
+			db: `directory: a
+begin: a
+song_begin: 1.flac
+Title: One
+song_end
+song_begin: 2.flac
+Title: Two`,
+			want:      []string{"a/1.flac", "a/2.flac"},
+			titles:    []string{"One", "Two"},
+			anomalies: 2, // and the directory left open
+		},
+		{
+			name:      "ends right after song_begin",
+			db:        "directory: a\nbegin: a\nsong_begin: 1.flac\n",
+			want:      []string{"a/1.flac"},
+			titles:    []string{""},
+			anomalies: 2,
+		},
+		{
+			name: "song_begin inside a song",
+			db: `song_begin: 1.flac
+Title: One
+song_begin: 2.flac
+Title: Two
+song_end
+`,
+			want:      []string{"1.flac", "2.flac"},
+			titles:    []string{"One", "Two"},
+			anomalies: 1,
+		},
+		{
+			name: "directory inside a song",
+			db: `directory: a
+begin: a
+song_begin: 1.flac
+directory: b
+begin: a/b
+song_begin: 2.flac
+song_end
+end: a/b
+end: a
+`,
+			want:      []string{"a/1.flac", "a/b/2.flac"},
+			titles:    []string{"", ""},
+			anomalies: 1,
+		},
+		{
+			name:      "tags outside a song",
+			db:        "Title: Stray\nsong_begin: 1.flac\nsong_end\n",
+			want:      []string{"1.flac"},
+			titles:    []string{""},
+			anomalies: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			collectTestAnomalies(t)
+			tracks := parseDb(t, tt.db)
+			if got := paths(tracks); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if len(anomalies) != tt.anomalies {
+				t.Errorf("anomalies %q, want %d", anomalies, tt.anomalies)
+			}
+			// Every song keeps its own tags, nothing carries over
+			titles := []string{}
+			for _, track := range tracks {
+				titles = append(titles, track.Title)
+			}
+			if !reflect.DeepEqual(titles, tt.titles) {
+				t.Errorf("titles %q, want %q", titles, tt.titles)
+			}
+		})
+	}
+}
+
+func TestSlowMovesEachGetTheTimeout(t *testing.T) {
+	songs := []string{}
+	for i := 0; i < 10; i++ {
+		songs = append(songs, fmt.Sprintf("%d.flac", i))
+	}
+	file := fakeMpcQueue(t, []string{"playing.flac", "next.flac"}, 1)
+	setEnv(t, "MOVE_DELAY", "0.05")
+	old := *mpcTimeout
+	*mpcTimeout = 300 * time.Millisecond
+	defer func() { *mpcTimeout = old }()
+
+	// Longer than the timeout altogether, far shorter each
+	if _, inserted, err := insertSongs(songs); err != nil || inserted != len(songs) {
+		t.Fatalf("inserted %d of %d: %v", inserted, len(songs), err)
+	}
+	queue, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "playing.flac\n" + strings.Join(songs, "\n") + "\nnext.flac\n"
+	if string(queue) != want {
+		t.Errorf("queue is\n%s\nwant\n%s", queue, want)
+	}
+}
+
+func TestUnclosedDirectories(t *testing.T) {
+	collectTestAnomalies(t)
+	tracks := parseDb(t, `directory: a
+begin: a
+directory: b
+begin: a/b
+song_begin: 1.flac
+song_end
+`)
+	if got := paths(tracks); !reflect.DeepEqual(got, []string{"a/b/1.flac"}) {
+		t.Errorf("got %q", got)
+	}
+	if len(anomalies) != 1 || !strings.Contains(anomalies[0], "'a', 'a/b' without a matching 'end'") {
+		t.Errorf("anomalies %q, want both directories named", anomalies)
+	}
+}
+
+func TestLongTagLine(t *testing.T) {
+	lyrics := strings.Repeat("la ", 40000)
+	db := strings.Replace(testDb, "Title: One\n", "Title: One\nLyrics: "+lyrics+"\n", 1)
+	for _, nul := range []bool{false, true} {
+		setBool(t, nulRecords, nul)
+		in := db
+		if nul {
+			in = strings.Replace(db, "\n", "\x00", -1)
+		}
+		tracks, err := readDbFrom(strings.NewReader(in))
+		if err != nil {
+			t.Fatalf("-nul=%t: %v", nul, err)
+		}
+		if len(tracks) != 2 || tracks[1].Title != "Two" {
+			t.Errorf("-nul=%t: got %q after the long line", nul, paths(tracks))
+		}
+	}
+}
+
+func TestCompactAlbumSameNames(t *testing.T) {
+	setBool(t, compactAlbum, true)
+	tracks := []*Track{
+		{Artist: "One", Title: "A", Album: "Greatest Hits", Path: "one/a.flac"},
+		{Artist: "One", Title: "B", Album: "Greatest Hits", Path: "one/b.flac"},
+		{Artist: "Two", Title: "C", Album: "Greatest Hits", Path: "two/c.flac"},
+	}
+	format := trackFormatter()
+	for i, want := range []bool{true, false, true} {
+		line := format(tracks[i])
+		if shown := strings.Contains(line, "{Greatest Hits}"); shown != want {
+			t.Errorf("%s: album shown %t, want %t in %q", tracks[i].Path, shown, want, line)
+		}
+	}
+}
+
+// A library about the size of a large real one
+func benchTracks() []*Track {
+	tracks := make([]*Track, 20000)
+	for i := range tracks {
+		artist := fmt.Sprintf("Artist %d", i/200)
+		tracks[i] = &Track{
+			Artist:      artist,
+			AlbumArtist: artist,
+			Album:       fmt.Sprintf("Album %d", i/12),
+			Title:       fmt.Sprintf("Some Song Title %d", i),
+			Time:        "(04:05)",
+			Path:        fmt.Sprintf("%s/Album %d/%02d Some Song Title %d.flac", artist, i/12, i%12+1, i),
+		}
+	}
+	return tracks
+}
+
+// Writes to a pipe like fzf's stdin, so unbuffered writes cost a syscall each
+func benchPipe(b *testing.B) (io.WriteCloser, func()) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		b.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, r)
+		r.Close()
+		close(done)
+	}()
+	return w, func() {
+		w.Close()
+		<-done
+	}
+}
+
+func BenchmarkWriteLines(b *testing.B) {
+	tracks := benchTracks()
+	writes := []struct {
+		name  string
+		write func(*testing.B, io.Writer)
+	}{
+		// How lines were written before they were batched
+		{"fprintln", func(b *testing.B, w io.Writer) {
+			format := trackFormatter()
+			for _, t := range tracks {
+				fmt.Fprintln(w, format(t))
+			}
+		}},
+		{"unbuffered", func(b *testing.B, w io.Writer) { writeLines(w, tracks) }},
+		{"buffered", func(b *testing.B, w io.Writer) {
+			buf := bufio.NewWriterSize(w, 64*1024)
+			writeLines(buf, tracks)
+			if err := buf.Flush(); err != nil {
+				b.Fatal(err)
+			}
+		}},
+	}
+	for _, bb := range writes {
+		b.Run(bb.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				w, closePipe := benchPipe(b)
+				bb.write(b, w)
+				closePipe()
+			}
+		})
+	}
+}
+
+func TestAlbumOnlyTrack(t *testing.T) {
+	tests := []struct {
+		track *Track
+		want  string
+	}{
+		{&Track{Album: "Demos", Filename: "take 3.flac", Path: "Demos/take 3.flac"}, "{Demos} - take 3"},
+		// With a title the album stays at the end
+		{&Track{Album: "Demos", Title: "Song", Filename: "take 3.flac", Path: "Demos/take 3.flac"}, "Song {Demos}"},
+		{&Track{Filename: "take 3.flac", Path: "take 3.flac"}, "take 3"},
+	}
+	for _, tt := range tests {
+		line := trackFormatter()(tt.track)
+		if !strings.HasPrefix(line, tt.want+" ") {
+			t.Errorf("%s: line %q, want it to start with %q", tt.track.Path, line, tt.want)
+		}
+	}
+}
+
+func TestNoTruncate(t *testing.T) {
+	setEnv(t, "COLUMNS", "40")
+	title := strings.Repeat("Very Long Title ", 5)
+	track := &Track{Artist: "Artist", Title: title, Time: "(01:01)", Path: "a/b.flac"}
+
+	line := trackFormatter()(track)
+	if strings.Contains(line, title) {
+		t.Errorf("line %q, want the title cut to fit 40 columns", line)
+	}
+
+	setBool(t, noTruncate, true)
+	line = trackFormatter()(track)
+	if want := "Artist - " + title + " (01:01)" + delimiter + "a/b.flac"; line != want {
+		t.Errorf("line %q, want %q", line, want)
+	}
+	if args := strings.Join(trackFzfArgs(), " "); !strings.Contains(args, "--with-nth=1") {
+		t.Errorf("args %q, want --with-nth=1 to hide the path", args)
+	}
+}
+
+func TestCleanPaths(t *testing.T) {
+	const messy = "a/./b//c/../d.flac"
+	// Joining the directories already cleans database paths
+	db := `format: 2
+directory: a
+begin: a
+directory: .
+begin: a/.
+directory: b/
+begin: a/b
+directory: c
+begin: a/b/c
+directory: ..
+begin: a/b
+song_begin: d.flac
+Title: D
+song_end
+end: a/b
+end: a/b/c
+end: a/b
+end: a/.
+end: a
+`
+	if got := paths(parseDb(t, db)); !reflect.DeepEqual(got, []string{"a/b/d.flac"}) {
+		t.Errorf("database paths %q, want a/b/d.flac", got)
+	}
+
+	listallinfo := "file: " + messy + "\nTitle: D\nOK\n"
+	protocol := func() []string {
+		tracks, err := parse(bufio.NewScanner(strings.NewReader(listallinfo)), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return paths(tracks)
+	}
+	if got := protocol(); !reflect.DeepEqual(got, []string{messy}) {
+		t.Errorf("listallinfo paths %q, want them as given without -clean-paths", got)
+	}
+
+	setBool(t, cleanPaths, true)
+	if got := protocol(); !reflect.DeepEqual(got, []string{"a/b/d.flac"}) {
+		t.Errorf("listallinfo paths %q, want a/b/d.flac", got)
+	}
+
+	tracks := []*Track{{Title: "D", Path: "a/b/d.flac"}}
+	list := writeFile(t, t.TempDir(), "tracks", messy+"\n")
+	if got := paths(tracksFromFile(tracks, list)); !reflect.DeepEqual(got, []string{"a/b/d.flac"}) {
+		t.Errorf("tracks from file %q, want a/b/d.flac", got)
+	}
+
+	twice := []*Track{{Path: "a/b/d.flac"}, {Path: messy}}
+	if got := paths(dedupeTracks(twice, "path")); len(got) != 1 {
+		t.Errorf("deduped %q, want one copy", got)
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A minimal client for the parts of the MPD protocol mpc can't provide
+
+var interactiveRemove = flag.Bool("interactive-remove", false,
+	"Ask before removing each existing copy of a selected song from the queue")
+
+type mpdConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// Resolves MPD_HOST and MPD_PORT the same way mpc does, from the environment
+// mpc commands are given
+func mpdAddress() (network, address, password string) {
+	host, port := os.Getenv("MPD_HOST"), os.Getenv("MPD_PORT")
+	for _, kv := range mpcEnv {
+		if strings.HasPrefix(kv, "MPD_HOST=") {
+			host = strings.TrimPrefix(kv, "MPD_HOST=")
+		} else if strings.HasPrefix(kv, "MPD_PORT=") {
+			port = strings.TrimPrefix(kv, "MPD_PORT=")
+		}
+	}
+
+	// password@host, but not an abstract socket named @something
+	if i := strings.LastIndex(host, "@"); i > 0 {
+		password, host = host[:i], host[i+1:]
+	}
+	if strings.HasPrefix(host, "/") || strings.HasPrefix(host, "@") {
+		return "unix", host, password
+	}
+
+	if host == "" {
+		host = "localhost"
+	}
+	if port == "" {
+		port = "6600"
+	}
+	return "tcp", net.JoinHostPort(host, port), password
+}
+
+func dialMpd() (*mpdConn, error) {
+	network, address, password := mpdAddress()
+	// Like mpc under -mpc-timeout, a dead server shouldn't hang everything
+	conn, err := net.DialTimeout(network, address, *mpcTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &mpdConn{conn: conn, r: bufio.NewReader(conn)}
+	c.setTimeout()
+
+	greeting, err := c.r.ReadString('\n')
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	if !strings.HasPrefix(greeting, "OK MPD ") {
+		c.Close()
+		return nil, fmt.Errorf("Unexpected greeting from MPD at %s: %q", address, greeting)
+	}
+
+	if password != "" {
+		if err = c.command("password " + quoteArg(password)); err == nil {
+			err = c.readResponse(func(string, string) {})
+		}
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (c *mpdConn) Close() error {
+	return c.conn.Close()
+}
+
+func quoteArg(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	return `"` + strings.Replace(s, `"`, `\"`, -1) + `"`
+}
+
+func (c *mpdConn) command(cmd string) error {
+	_, err := fmt.Fprintln(c.conn, cmd)
+	return err
+}
+
+// Calls handle for every key/value pair until the terminating OK, returning
+// an error for ACK.
+func (c *mpdConn) readResponse(handle func(key, value string)) error {
+	scan := bufio.NewScanner(c.r)
+	// Tag values can be long, don't let them kill the connection
+	scan.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scan.Scan() {
+		line := scan.Text()
+		if line == "OK" {
+			return nil
+		}
+		if strings.HasPrefix(line, "ACK ") {
+			return errors.New("MPD error: " + line)
+		}
+		handle(keyval(line))
+	}
+	if err := scan.Err(); err != nil {
+		return err
+	}
+	return errors.New("MPD closed the connection unexpectedly")
+}
+
+// Gives up on the connection after -mpc-timeout, like mpcContext
+func (c *mpdConn) setTimeout() {
+	if *mpcTimeout > 0 {
+		c.conn.SetDeadline(time.Now().Add(*mpcTimeout))
+	}
+}
+
+// Reads every song from the running server instead of the database file
+func readProtocolTracks() ([]*Track, error) {
+	c, err := dialMpd()
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	if err = c.command("listallinfo"); err != nil {
+		return nil, err
+	}
+
+	scan := bufio.NewScanner(c.r)
+	// The same limit as readResponse, a long tag shouldn't lose the library
+	scan.Buffer(make([]byte, 64*1024), 1024*1024)
+	return parse(scan, true)
+}
+
+// Removes every queue entry for the songs by their ids, which unlike
+// positions don't change as other entries are removed. Returns the 1-based
+// positions the removed entries had.
+func removeSongs(songs []string) ([]int, error) {
+	fnames := make(map[string]struct{})
+	for _, s := range songs {
+		if s != "" {
+			fnames[s] = struct{}{}
+		}
+	}
+
+	c, err := dialMpd()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { c.Close() }()
+	c.setTimeout()
+
+	if err = c.command("playlistinfo"); err != nil {
+		return nil, err
+	}
+	type entry struct{ file, pos, id string }
+	entries := []entry{}
+	var file, pos string
+	err = c.readResponse(func(key, value string) {
+		switch key {
+		case "file":
+			file = value
+		case "Pos":
+			pos = value
+		case "Id":
+			if _, ok := fnames[file]; ok {
+				entries = append(entries, entry{file, pos, value})
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ids, positions := []string{}, []int{}
+	for _, e := range entries {
+		// Positions are 0-based in the protocol but 1-based everywhere users see them
+		p, _ := strconv.Atoi(e.pos)
+		if *interactiveRemove && !confirm(fmt.Sprintf("Remove %s at position %d?", e.file, p+1)) {
+			continue
+		}
+		debug("Removing id %s: %s", e.id, e.file)
+		ids = append(ids, e.id)
+		positions = append(positions, p+1)
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	if *interactiveRemove {
+		// MPD drops idle clients, and the prompts may have taken a while
+		c.Close()
+		fresh, err := dialMpd()
+		if err != nil {
+			return nil, err
+		}
+		c = fresh
+		c.setTimeout()
+	}
+
+	cmds := []string{"command_list_begin"}
+	for _, id := range ids {
+		cmds = append(cmds, "deleteid "+id)
+	}
+	cmds = append(cmds, "command_list_end")
+	if err = c.command(strings.Join(cmds, "\n")); err != nil {
+		return nil, err
+	}
+	return positions, c.readResponse(func(string, string) {})
+}
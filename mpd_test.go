@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Serves the MPD protocol on a Unix socket, answering each command, or each
+// command list joined by ";", with respond. mpcEnv points at it for the rest of
+// the test.
+func fakeMpd(t *testing.T, respond func(cmd string) string) {
+	t.Helper()
+	sock := filepath.Join(t.TempDir(), "mpd.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldEnv := mpcEnv
+	mpcEnv = []string{"MPD_HOST=" + sock}
+	t.Cleanup(func() {
+		l.Close()
+		mpcEnv = oldEnv
+	})
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveFakeMpd(c, respond)
+		}
+	}()
+}
+
+func serveFakeMpd(c net.Conn, respond func(cmd string) string) {
+	defer c.Close()
+	fmt.Fprint(c, "OK MPD 0.23.5\n")
+	r := bufio.NewReader(c)
+	var list []string
+	inList := false
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "command_list_begin":
+			inList = true
+		case line == "command_list_end":
+			inList = false
+			fmt.Fprint(c, respond(strings.Join(list, ";")))
+			list = nil
+		case inList:
+			list = append(list, line)
+		default:
+			fmt.Fprint(c, respond(line))
+		}
+	}
+}
+
+// Trimmed from a real listallinfo response
+var listallinfo = `directory: Artist
+Last-Modified: 2020-01-02T03:04:05Z
+directory: Artist/Album
+Last-Modified: 2020-01-02T03:04:05Z
+file: Artist/Album/01 One.flac
+Last-Modified: 2020-01-02T03:04:05Z
+Format: 44100:16:2
+Artist: Artist
+Album: Album
+Title: One
+Track: 1
+Time: 61
+duration: 61.234
+file: Artist/Album/02 Two.flac
+Last-Modified: 2020-01-02T03:04:05Z
+Artist: Artist
+Album: Album
+Title: ` + strings.Repeat("Long ", 20000) + `
+Track: 2
+playlist: Artist/Album/album.m3u
+Last-Modified: 2020-01-02T03:04:05Z
+OK
+`
+
+func TestReadProtocolTracks(t *testing.T) {
+	fakeMpd(t, func(cmd string) string {
+		if cmd == "listallinfo" {
+			return listallinfo
+		}
+		return "ACK [5@0] {} unknown command \"" + cmd + "\"\n"
+	})
+
+	tracks, err := readProtocolTracks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tracks) != 2 {
+		t.Fatalf("got %d tracks, want 2", len(tracks))
+	}
+	first := tracks[0]
+	if first.Path != "Artist/Album/01 One.flac" || first.Filename != "01 One.flac" ||
+		first.Title != "One" || first.TrackNo != 1 || first.Time != "(01:01)" {
+		t.Errorf("first track: %+v", first)
+	}
+	if tracks[1].TrackNo != 2 || len(tracks[1].Title) < 64*1024 {
+		t.Errorf("second track lost its tags after the long title")
+	}
+}
+
+func TestReadProtocolTracksAck(t *testing.T) {
+	fakeMpd(t, func(cmd string) string {
+		return "file: a.flac\nACK [50@0] {listallinfo} No such directory\n"
+	})
+	if _, err := readProtocolTracks(); err == nil || !strings.Contains(err.Error(), "No such directory") {
+		t.Errorf("got %v, want the ACK", err)
+	}
+}
+
+type queueEntry struct {
+	file string
+	id   int
+}
+
+// A fake MPD with a queue that playlistinfo and deleteid work on
+func fakeQueue(t *testing.T, queue []queueEntry) *[]queueEntry {
+	t.Helper()
+	var mu sync.Mutex
+	fakeMpd(t, func(cmd string) string {
+		mu.Lock()
+		defer mu.Unlock()
+		if cmd == "playlistinfo" {
+			var b strings.Builder
+			for i, e := range queue {
+				fmt.Fprintf(&b, "file: %s\nPos: %d\nId: %d\n", e.file, i, e.id)
+			}
+			return b.String() + "OK\n"
+		}
+		for _, c := range strings.Split(cmd, ";") {
+			var id int
+			if _, err := fmt.Sscanf(c, "deleteid %d", &id); err != nil {
+				return "ACK [5@0] {} unknown command\n"
+			}
+			for i, e := range queue {
+				if e.id == id {
+					queue = append(queue[:i:i], queue[i+1:]...)
+					break
+				}
+			}
+		}
+		return "OK\n"
+	})
+	return &queue
+}
+
+func queueFiles(queue []queueEntry) []string {
+	files := []string{}
+	for _, e := range queue {
+		files = append(files, e.file)
+	}
+	return files
+}
+
+func TestRemoveDuplicatesAtSeveralPositions(t *testing.T) {
+	queue := fakeQueue(t, []queueEntry{
+		{"a.flac", 1}, {"b.flac", 2}, {"a.flac", 3}, {"c.flac", 4}, {"a.flac", 5},
+	})
+	positions, err := removeSongs([]string{"a.flac"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{1, 3, 5}; !reflect.DeepEqual(positions, want) {
+		t.Errorf("removed positions %v, want %v", positions, want)
+	}
+	if got, want := queueFiles(*queue), []string{"b.flac", "c.flac"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("queue is %q, want %q", got, want)
+	}
+}
+
+func TestRemoveSongsByID(t *testing.T) {
+	var deleted string
+	fakeMpd(t, func(cmd string) string {
+		if cmd == "playlistinfo" {
+			// Ids don't follow positions once the queue has been rearranged
+			return "file: c.flac\nPos: 0\nId: 40\n" +
+				"file: a.flac\nPos: 1\nId: 7\n" +
+				"file: a.flac.bak\nPos: 2\nId: 12\n" +
+				"file: b.flac\nPos: 3\nId: 3\n" +
+				"file: a.flac\nPos: 4\nId: 21\nOK\n"
+		}
+		deleted = cmd
+		return "OK\n"
+	})
+	if _, err := removeSongs([]string{"a.flac", "c.flac"}); err != nil {
+		t.Fatal(err)
+	}
+	if want := "deleteid 40;deleteid 7;deleteid 21"; deleted != want {
+		t.Errorf("sent %q, want %q", deleted, want)
+	}
+}
+
+func TestRemoveSongsFromHungMpd(t *testing.T) {
+	// Accepts connections but never greets them
+	sock := filepath.Join(t.TempDir(), "mpd.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+	oldEnv, oldTimeout := mpcEnv, *mpcTimeout
+	mpcEnv, *mpcTimeout = []string{"MPD_HOST=" + sock}, 200*time.Millisecond
+	defer func() { mpcEnv, *mpcTimeout = oldEnv, oldTimeout }()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := removeSongs([]string{"a.flac"})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("removing from a server that never answered should fail")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("removeSongs hung waiting for the greeting")
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+var (
+	showPreview = flag.Bool("preview", false,
+		"Show everything known about the highlighted track in fzf's preview window")
+	previewFor = flag.Int("preview-for", -1,
+		"Print the preview of the Nth track sent to fzf and exit, used by -preview")
+)
+
+// Where the preview index is, for the copies of mpd-fzf fzf starts
+const previewEnv = "MPD_FZF_PREVIEW_INDEX"
+
+// Removed once fzf exits
+var fzfTempFiles []string
+
+// The preview of every track sent to fzf, so a preview only has to seek to its
+// own text instead of reading the database again. The file holds the number of
+// tracks, then the offset of each preview and of the end, then the previews.
+func writePreviewIndex(tracks []*Track) (string, error) {
+	f, err := ioutil.TempFile("", "mpd-fzf-preview-*")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	offsets := make([]uint64, len(tracks)+1)
+	header := uint64(8 * (len(offsets) + 1))
+	var text strings.Builder
+	for i, t := range tracks {
+		offsets[i] = header + uint64(text.Len())
+		text.WriteString(previewText(t))
+	}
+	offsets[len(tracks)] = header + uint64(text.Len())
+
+	w := bufio.NewWriter(f)
+	binary.Write(w, binary.LittleEndian, uint64(len(tracks)))
+	binary.Write(w, binary.LittleEndian, offsets)
+	w.WriteString(text.String())
+	if err = w.Flush(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+func previewText(t *Track) string {
+	var b strings.Builder
+	line := func(name, value string) {
+		if value != "" {
+			fmt.Fprintf(&b, "%-13s%s\n", name+":", value)
+		}
+	}
+	line("Title", t.Title)
+	line("Artist", t.Artist)
+	line("Album Artist", t.AlbumArtist)
+	line("Album", t.Album)
+	line("Disc", numberField(t.Disc))
+	line("Track", numberField(t.TrackNo))
+	line("Date", t.Date)
+	line("Genre", t.Genre())
+	line("Composer", t.Composer)
+	line("Performer", t.Performer)
+	line("Duration", strings.Trim(t.Time, "()"))
+	line("Path", t.Path)
+	return b.String()
+}
+
+func printPreview(w io.Writer, n int) error {
+	path := os.Getenv(previewEnv)
+	if path == "" {
+		return errors.New("-preview-for is only for the previews started by -preview")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var count uint64
+	if err = binary.Read(f, binary.LittleEndian, &count); err != nil {
+		return err
+	}
+	if uint64(n) >= count {
+		return fmt.Errorf("There is no track %d to preview", n)
+	}
+	bounds := make([]uint64, 2)
+	if _, err = f.Seek(int64(8*(n+1)), io.SeekStart); err != nil {
+		return err
+	}
+	if err = binary.Read(f, binary.LittleEndian, bounds); err != nil {
+		return err
+	}
+	if _, err = f.Seek(int64(bounds[0]), io.SeekStart); err != nil {
+		return err
+	}
+	_, err = io.CopyN(w, f, int64(bounds[1]-bounds[0]))
+	return err
+}
+
+// The fzf arguments for -preview over tracks, in the order they're sent
+func previewArgs(tracks []*Track) []string {
+	index, err := writePreviewIndex(tracks)
+	fail(err)
+	fzfTempFiles = append(fzfTempFiles, index)
+	fail(os.Setenv(previewEnv, index))
+	self, err := os.Executable()
+	fail(err)
+	// {n} is the line's position in fzf's input, which doesn't change as it filters
+	return []string{"--preview=" + quoteShell(self) + " -preview-for {n}"}
+}
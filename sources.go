@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A database given with -db-file, and the MPD instance its tracks belong to
+type dbSource struct {
+	File  string
+	Label string
+	Host  string
+	Port  string
+}
+
+type dbSourceList []*dbSource
+
+var dbSources dbSourceList
+
+var showSource = flag.Bool("show-source", false,
+	"Prefix each track with the label of the -db-file it came from")
+
+var dbDir = flag.String("db-dir", "",
+	"Read every *.db and *.db.gz database in this directory as if each was given with -db-file")
+
+func init() {
+	flag.Var(&dbSources, "db-file",
+		"Read this database instead of the one from mpd.conf, may be repeated. "+
+			"Append ',label=NAME' to name it and ',host=HOST' or ',port=PORT' to queue its tracks on "+
+			"a different MPD instance")
+}
+
+func (l *dbSourceList) String() string {
+	files := []string{}
+	for _, s := range *l {
+		files = append(files, s.File)
+	}
+	return strings.Join(files, " ")
+}
+
+func (l *dbSourceList) Set(value string) error {
+	parts := strings.Split(value, ",")
+	s := &dbSource{File: parts[0]}
+	if s.File == "" {
+		return errors.New("missing database path")
+	}
+	for _, opt := range parts[1:] {
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("invalid option '%s', expected key=value", opt)
+		}
+		switch kv[0] {
+		case "label":
+			s.Label = kv[1]
+		case "host":
+			s.Host = kv[1]
+		case "port":
+			s.Port = kv[1]
+		default:
+			return fmt.Errorf("unknown option '%s'", kv[0])
+		}
+	}
+	if s.Label == "" {
+		s.Label = filepath.Base(s.File)
+	}
+	// The label is kept out of fzf's search as a single whitespace separated field
+	if strings.ContainsAny(s.Label, " \t") {
+		return fmt.Errorf("label '%s' cannot contain whitespace", s.Label)
+	}
+	*l = append(*l, s)
+	return nil
+}
+
+// Adds the databases from -db-dir to dbSources, labelled by filename
+func addDirSources(dir string) error {
+	files := []string{}
+	for _, pattern := range []string{"*.db", "*.db.gz"} {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return err
+		}
+		files = append(files, matches...)
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("No *.db or *.db.gz files in '%s'", dir)
+	}
+	sort.Strings(files)
+
+	for _, f := range files {
+		label := strings.TrimSuffix(strings.TrimSuffix(filepath.Base(f), ".gz"), ".db")
+		label = strings.Join(strings.Fields(label), "_")
+		dbSources = append(dbSources, &dbSource{File: f, Label: label})
+	}
+	return nil
+}
+
+// The environment for mpc commands acting on this source's tracks
+func (s *dbSource) env() []string {
+	if s == nil || (s.Host == "" && s.Port == "") {
+		return configMpcEnv
+	}
+	env := []string{}
+	if s.Host != "" {
+		env = append(env, "MPD_HOST="+s.Host)
+	}
+	if s.Port != "" {
+		env = append(env, "MPD_PORT="+s.Port)
+	}
+	return env
+}
+
+func readSources() []*Track {
+	tracks := []*Track{}
+	for _, s := range dbSources {
+		st := readDbFile(s.File)
+		for _, t := range st {
+			t.source = s
+		}
+		tracks = append(tracks, st...)
+	}
+	return tracks
+}
+
+// Songs to queue on one MPD instance, and the mpc environment that reaches it
+type songGroup struct {
+	env   []string
+	songs []string
+}
+
+// Splits the selection by the MPD instance each song should be queued on,
+// keeping the selection order within each instance. Sources without a host or
+// port all share the server from mpd.conf, so they end up in one group.
+func routeSongs(tracks []*Track, songs []string) []songGroup {
+	if len(dbSources) == 0 {
+		return []songGroup{{env: configMpcEnv, songs: songs}}
+	}
+
+	byPath := make(map[string]*dbSource, len(tracks))
+	for _, t := range tracks {
+		if prev, ok := byPath[t.Path]; ok && prev != t.source {
+			// Only the path comes back from fzf, so there's no way to tell them apart
+			debug("'%s' is in both %s and %s, using %s", t.Path, prev.Label, t.source.Label, prev.Label)
+			continue
+		}
+		byPath[t.Path] = t.source
+	}
+
+	groups := []songGroup{}
+	index := map[string]int{}
+	for _, s := range songs {
+		env := byPath[s].env()
+		key := strings.Join(env, "\x00")
+		i, ok := index[key]
+		if !ok {
+			i = len(groups)
+			index[key] = i
+			groups = append(groups, songGroup{env: env})
+		}
+		groups[i].songs = append(groups[i].songs, s)
+	}
+	return groups
+}
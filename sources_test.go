@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestRouteSongsByServer(t *testing.T) {
+	local1 := &dbSource{File: "a.db", Label: "a"}
+	local2 := &dbSource{File: "b.db", Label: "b"}
+	remote := &dbSource{File: "c.db", Label: "c", Host: "elsewhere"}
+	oldSources, oldEnv := dbSources, configMpcEnv
+	dbSources = dbSourceList{local1, local2, remote}
+	configMpcEnv = []string{"MPD_HOST=/run/mpd/socket"}
+	defer func() { dbSources, configMpcEnv = oldSources, oldEnv }()
+
+	tracks := []*Track{
+		{Path: "a/1", source: local1},
+		{Path: "b/2", source: local2},
+		{Path: "c/3", source: remote},
+		{Path: "a/4", source: local1},
+	}
+	groups := routeSongs(tracks, []string{"b/2", "c/3", "a/4", "a/1"})
+	want := []songGroup{
+		{env: configMpcEnv, songs: []string{"b/2", "a/4", "a/1"}},
+		{env: []string{"MPD_HOST=elsewhere"}, songs: []string{"c/3"}},
+	}
+	if !reflect.DeepEqual(groups, want) {
+		t.Errorf("got %v, want %v", groups, want)
+	}
+}
+
+// Splits a line the way fzf does with a --delimiter regex, each field keeping
+// the delimiter that ends it
+func fzfFields(line, pattern string) []string {
+	var fields []string
+	begin := 0
+	for _, loc := range regexp.MustCompile(pattern).FindAllStringIndex(line, -1) {
+		fields = append(fields, line[begin:loc[1]])
+		begin = loc[1]
+	}
+	return append(fields, line[begin:])
+}
+
+func TestShowSourceNoTruncate(t *testing.T) {
+	oldSources := dbSources
+	source := &dbSource{File: "a.db", Label: "lib[1]"}
+	dbSources = dbSourceList{source}
+	defer func() { dbSources = oldSources }()
+	setBool(t, showSource, true)
+	setBool(t, noTruncate, true)
+
+	args := trackFzfArgs()
+	var pattern string
+	for _, a := range args {
+		if strings.HasPrefix(a, "--delimiter=") {
+			pattern = strings.TrimPrefix(a, "--delimiter=")
+		}
+	}
+	joined := strings.Join(args, " ")
+	if pattern == "" || !strings.Contains(joined, "--with-nth=..2") || !strings.Contains(joined, "--nth=2") {
+		t.Fatalf("args %q, want a delimiter, --with-nth=..2 and --nth=2", args)
+	}
+
+	track := &Track{Artist: "Artist", Title: "Title", Time: "(01:01)", Path: "lib/song.flac", source: source}
+	fields := fzfFields(trackFormatter()(track), pattern)
+	if len(fields) != 3 {
+		t.Fatalf("fields %q, want the label, the text and the path", fields)
+	}
+	// fzf splits what --with-nth leaves again before applying --nth
+	shown := fzfFields(fields[0]+fields[1], pattern)
+	if len(shown) < 2 || strings.Contains(shown[1], "lib[1]") || !strings.Contains(shown[1], "Artist - Title") {
+		t.Errorf("searched %q, want the text without the label", shown)
+	}
+	if strings.Contains(shown[0]+shown[1], "lib/song.flac") {
+		t.Errorf("displayed %q, want no path", shown)
+	}
+}
+
+func TestAddDirSources(t *testing.T) {
+	oldSources := dbSources
+	defer func() { dbSources = oldSources }()
+
+	dir := t.TempDir()
+	writeFile(t, dir, "x.db", testDb)
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	if _, err := w.Write([]byte(strings.Replace(testDb, "Artist", "Other", -1))); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, dir, "y y.db.gz", gz.String())
+	writeFile(t, dir, "notes.txt", testDb)
+	writeFile(t, dir, "z.db.bak", testDb)
+
+	dbSources = nil
+	if err := addDirSources(dir); err != nil {
+		t.Fatal(err)
+	}
+	labels := []string{}
+	for _, s := range dbSources {
+		labels = append(labels, s.Label)
+	}
+	if want := []string{"x", "y_y"}; !reflect.DeepEqual(labels, want) {
+		t.Fatalf("labels %q, want %q", labels, want)
+	}
+	if dbSources[1].File != filepath.Join(dir, "y y.db.gz") {
+		t.Errorf("file %q, want the gzipped database", dbSources[1].File)
+	}
+
+	tracks := readSources()
+	want := []string{"Artist/one.flac", "Artist/two.flac", "Other/one.flac", "Other/two.flac"}
+	if got := paths(tracks); !reflect.DeepEqual(got, want) {
+		t.Errorf("tracks %q, want %q", got, want)
+	}
+	for i, tr := range tracks {
+		if want := dbSources[i/2]; tr.source != want {
+			t.Errorf("%s: source %+v, want %+v", tr.Path, tr.source, want)
+		}
+	}
+
+	dbSources = nil
+	if err := addDirSources(t.TempDir()); err == nil {
+		t.Error("no error for a directory without databases")
+	}
+}
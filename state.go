@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Persistent state lives in $XDG_STATE_HOME/mpd-fzf, falling back to
+// ~/.local/state/mpd-fzf
+func stateDir() (string, error) {
+	base := os.Getenv("XDG_STATE_HOME")
+	if base == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		base = filepath.Join(home, ".local", "state")
+	}
+	dir := filepath.Join(base, "mpd-fzf")
+	return dir, os.MkdirAll(dir, 0700)
+}
+
+func statePath(name string) (string, error) {
+	dir, err := stateDir()
+	return filepath.Join(dir, name), err
+}
+
+// Returns the 1-based queue position saved by -set-bookmark
+func readBookmark() (int, error) {
+	path, err := statePath("bookmark")
+	if err != nil {
+		return 0, err
+	}
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, errors.New("No bookmark has been set, use -set-bookmark first")
+	} else if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(contents)))
+}
+
+func writeBookmark(pos int) error {
+	path, err := statePath("bookmark")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, []byte(strconv.Itoa(pos)+"\n"), 0600)
+}
+
+// Returns when a selection was last queued or printed, zero if one never was
+func readLastRun() (time.Time, error) {
+	path, err := statePath("last-run")
+	if err != nil {
+		return time.Time{}, err
+	}
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return time.Time{}, nil
+	} else if err != nil {
+		return time.Time{}, err
+	}
+	secs, err := strconv.ParseInt(strings.TrimSpace(string(contents)), 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(secs, 0), nil
+}
+
+func writeLastRun(t time.Time) error {
+	path, err := statePath("last-run")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, []byte(strconv.FormatInt(t.Unix(), 10)+"\n"), 0600)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+type libraryStats struct {
+	Tracks       int            `json:"tracks"`
+	Artists      int            `json:"artists"`
+	Albums       int            `json:"albums"`
+	TotalSeconds int64          `json:"total_seconds"`
+	Genres       map[string]int `json:"genres"`
+}
+
+func computeStats(tracks []*Track) libraryStats {
+	st := libraryStats{Tracks: len(tracks), Genres: map[string]int{}}
+	artists, albums := map[string]bool{}, map[string]bool{}
+	var total time.Duration
+	for _, t := range tracks {
+		if t.Artist != "" {
+			artists[t.Artist] = true
+		}
+		if t.Album != "" {
+			albums[artistKey(t)+delimiter+t.Album] = true
+		}
+		for _, g := range t.Genres {
+			st.Genres[g]++
+		}
+		total += t.Duration
+	}
+	st.Artists, st.Albums = len(artists), len(albums)
+	st.TotalSeconds = int64(total / time.Second)
+	return st
+}
+
+func printStats(w io.Writer, tracks []*Track, asJSON bool) error {
+	st := computeStats(tracks)
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(st)
+	}
+
+	fmt.Fprintf(w, "Tracks:   %d\n", st.Tracks)
+	fmt.Fprintf(w, "Artists:  %d\n", st.Artists)
+	fmt.Fprintf(w, "Albums:   %d\n", st.Albums)
+	fmt.Fprintf(w, "Duration: %s\n", time.Duration(st.TotalSeconds)*time.Second)
+
+	genres := make([]string, 0, len(st.Genres))
+	for g := range st.Genres {
+		genres = append(genres, g)
+	}
+	// Most common first
+	sort.Slice(genres, func(i, j int) bool {
+		if st.Genres[genres[i]] != st.Genres[genres[j]] {
+			return st.Genres[genres[i]] > st.Genres[genres[j]]
+		}
+		return genres[i] < genres[j]
+	})
+	if len(genres) > 0 {
+		fmt.Fprintln(w, "Genres:")
+	}
+	for _, g := range genres {
+		fmt.Fprintf(w, "  %6d %s\n", st.Genres[g], g)
+	}
+	return nil
+}
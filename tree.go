@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"sort"
+	"strings"
+)
+
+type treeNode struct {
+	children map[string]*treeNode
+}
+
+func newTreeNode() *treeNode {
+	return &treeNode{children: map[string]*treeNode{}}
+}
+
+// Prints the directories and files in the tracks' paths as an indented tree,
+// each level sorted alphabetically
+func printTree(w io.Writer, tracks []*Track) error {
+	root := newTreeNode()
+	for _, t := range tracks {
+		node := root
+		for _, part := range strings.Split(t.Path, "/") {
+			if part == "" {
+				continue
+			}
+			child, ok := node.children[part]
+			if !ok {
+				child = newTreeNode()
+				node.children[part] = child
+			}
+			node = child
+		}
+	}
+
+	out := bufio.NewWriter(w)
+	writeTree(out, root, 0)
+	return out.Flush()
+}
+
+func writeTree(w *bufio.Writer, node *treeNode, depth int) {
+	names := make([]string, 0, len(node.children))
+	for name := range node.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		child := node.children[name]
+		w.WriteString(strings.Repeat("  ", depth) + name)
+		if len(child.children) > 0 {
+			w.WriteString("/")
+		}
+		w.WriteString("\n")
+		writeTree(w, child, depth+1)
+	}
+}
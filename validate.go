@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// Prints one line per problem with the parsed tracks, including anomalies
+// collected while parsing, and returns the number of problems
+func validate(w io.Writer, tracks []*Track) int {
+	problems := len(anomalies)
+	for _, a := range anomalies {
+		fmt.Fprintln(w, a)
+	}
+
+	seen := map[string]bool{}
+	for _, t := range tracks {
+		if t.Title == "" {
+			fmt.Fprintf(w, "Missing title: %s\n", t.Path)
+			problems++
+		}
+		if t.Artist == "" {
+			fmt.Fprintf(w, "Missing artist: %s\n", t.Path)
+			problems++
+		}
+		if seen[t.Path] {
+			fmt.Fprintf(w, "Duplicate path: %s\n", t.Path)
+			problems++
+		}
+		seen[t.Path] = true
+	}
+
+	info("Checked %s, found %s", plural(len(tracks), "track"), plural(problems, "problem"))
+	return problems
+}